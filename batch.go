@@ -0,0 +1,236 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dropbox/godropbox/errors"
+	log "github.com/golang/glog"
+)
+
+// ShardedRedisClient 由shard版的RedisClient实现，
+// multi-key操作拆分批次时保证一个批次中的key都属于同一个shard
+type ShardedRedisClient interface {
+	RedisClient
+	ShardOf(key string) int
+}
+
+// BatchOptions 控制MultiGet/MultiSet/Delete等multi-key操作的拆分和并发，
+// 零值表示不拆分，和一次性执行一样
+type BatchOptions struct {
+	// BatchSize 大于0时每个批次最多BatchSize个key
+	BatchSize int
+	// Parallelism 大于1时最多同时执行Parallelism个批次，否则按顺序执行
+	Parallelism int
+	// FailFast 为true时遇到第一个失败的key(build key/encode/decode)或者批次就返回MultiError，
+	// 不再执行后面的key和批次
+	FailFast bool
+}
+
+// errBatchSkipped FailFast时前面的批次失败后没有执行的批次的error
+var errBatchSkipped = errors.New("batch skipped after previous failure")
+
+// firstError 返回errs中第一个不为nil的error
+func firstError(errs []error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keyErrors 把和batches一一对应的errs展开成和key一一对应的error，全部成功时返回nil
+func keyErrors(batches [][]int, errs []error, count int) []error {
+	if firstError(errs) == nil {
+		return nil
+	}
+	keyErrs := make([]error, count)
+	for b, batch := range batches {
+		for _, i := range batch {
+			keyErrs[i] = errs[b]
+		}
+	}
+	return keyErrs
+}
+
+// split 把cacheKeys分成多个批次，每个批次是key在cacheKeys中的下标。
+// client实现了ShardedRedisClient时先按shard分组再按BatchSize拆分
+func (this BatchOptions) split(client RedisClient, cacheKeys []string) [][]int {
+	var groups [][]int
+	if sharded, ok := client.(ShardedRedisClient); ok {
+		shardIndex := make(map[int]int)
+		for i, cacheKey := range cacheKeys {
+			shard := sharded.ShardOf(cacheKey)
+			group, ok := shardIndex[shard]
+			if !ok {
+				group = len(groups)
+				shardIndex[shard] = group
+				groups = append(groups, nil)
+			}
+			groups[group] = append(groups[group], i)
+		}
+	} else {
+		group := make([]int, len(cacheKeys))
+		for i := range group {
+			group[i] = i
+		}
+		groups = [][]int{group}
+	}
+	if this.BatchSize <= 0 {
+		return groups
+	}
+
+	var batches [][]int
+	for _, group := range groups {
+		for len(group) > this.BatchSize {
+			batches = append(batches, group[:this.BatchSize:this.BatchSize])
+			group = group[this.BatchSize:]
+		}
+		batches = append(batches, group)
+	}
+	return batches
+}
+
+// run 执行所有批次，返回和batches一一对应的error，
+// FailFast时有批次失败后还没有开始的批次不再执行，error为errBatchSkipped，
+// ctx结束后还没有开始的批次不再执行，error为ctx.Err()
+func (this BatchOptions) run(ctx context.Context, batches [][]int, fn func(batch []int) error) []error {
+	errs := make([]error, len(batches))
+	if this.Parallelism <= 1 || len(batches) == 1 {
+		for i, batch := range batches {
+			if this.FailFast && i > 0 && errs[i-1] != nil {
+				errs[i] = errBatchSkipped
+				continue
+			}
+			if err := ctx.Err(); err != nil {
+				errs[i] = redisError(err)
+				continue
+			}
+			errs[i] = fn(batch)
+		}
+		return errs
+	}
+
+	var wg sync.WaitGroup
+	var failed int32
+	sem := make(chan struct{}, this.Parallelism)
+	for i, batch := range batches {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			errs[i] = redisError(ctx.Err())
+			continue
+		}
+		if this.FailFast && atomic.LoadInt32(&failed) != 0 {
+			<-sem
+			errs[i] = errBatchSkipped
+			continue
+		}
+		wg.Add(1)
+		go func(i int, batch []int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			errs[i] = fn(batch)
+			if errs[i] != nil {
+				atomic.StoreInt32(&failed, 1)
+			}
+		}(i, batch)
+	}
+	wg.Wait()
+	return errs
+}
+
+// mget 分批执行get，返回和cacheKeys一一对应的结果，
+// 有批次失败时keyErrs和cacheKeys一一对应，保存每个key所在批次的error，失败的key结果为nil
+func (this BatchOptions) mget(ctx context.Context, client RedisClient, cacheKeys []string, get func(ctx context.Context, keys ...string) ([]interface{}, error)) (values []interface{}, keyErrs []error) {
+	if len(cacheKeys) == 0 {
+		return nil, nil
+	}
+	batches := this.split(client, cacheKeys)
+	values = make([]interface{}, len(cacheKeys))
+	errs := this.run(ctx, batches, func(batch []int) error {
+		keys := make([]string, len(batch))
+		for j, i := range batch {
+			keys[j] = cacheKeys[i]
+		}
+		batchValues, err := get(ctx, keys...)
+		if err != nil {
+			log.Warningf("redis mget batch error ,count=%d err=%v", len(keys), err)
+			return err
+		}
+		for j, i := range batch {
+			values[i] = batchValues[j]
+		}
+		return nil
+	})
+	return values, keyErrors(batches, errs, len(cacheKeys))
+}
+
+// mset 分批执行MSet，pairs是key/value交替的数组，
+// 有批次失败时keyErrs和pairs中的key一一对应
+func (this BatchOptions) mset(ctx context.Context, client RedisClient, expiration time.Duration, pairs []interface{}) (keyErrs []error) {
+	if len(pairs) == 0 {
+		return nil
+	}
+	cacheKeys := make([]string, len(pairs)/2)
+	for i := range cacheKeys {
+		cacheKeys[i] = pairKeyString(pairs[2*i])
+	}
+	batches := this.split(client, cacheKeys)
+	errs := this.run(ctx, batches, func(batch []int) error {
+		batchPairs := make([]interface{}, 0, 2*len(batch))
+		for _, i := range batch {
+			batchPairs = append(batchPairs, pairs[2*i], pairs[2*i+1])
+		}
+		err := client.MSet(ctx, expiration, batchPairs...)
+		if err != nil {
+			log.Warningf("redis mset batch error ,count=%d err=%v", len(batch), err)
+		}
+		return err
+	})
+	return keyErrors(batches, errs, len(cacheKeys))
+}
+
+// del 分批执行Del，返回删除的key的总数，有批次失败时keyErrs和cacheKeys一一对应
+func (this BatchOptions) del(ctx context.Context, client RedisClient, cacheKeys []string) (total int64, keyErrs []error) {
+	if len(cacheKeys) == 0 {
+		return 0, nil
+	}
+	batches := this.split(client, cacheKeys)
+	var lock sync.Mutex
+	errs := this.run(ctx, batches, func(batch []int) error {
+		keys := make([]string, len(batch))
+		for j, i := range batch {
+			keys[j] = cacheKeys[i]
+		}
+		n, err := client.Del(ctx, keys...)
+		if err != nil {
+			log.Warningf("redis del batch error ,count=%d err=%v", len(keys), err)
+			return err
+		}
+		lock.Lock()
+		total += n
+		lock.Unlock()
+		return nil
+	})
+	return total, keyErrors(batches, errs, len(cacheKeys))
+}
+
+func pairKeyString(key interface{}) string {
+	switch key := key.(type) {
+	case string:
+		return key
+	case []byte:
+		return string(key)
+	case BytesValue:
+		return string(key)
+	default:
+		return fmt.Sprint(key)
+	}
+}
@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// BatchLoader 把并发的Get合并成一次MultiGet(dataloader)，可以包装任意Storage，
+// 其它方法直接交给被包装的Storage。
+// MultiGet传入的map的value类型和Get的value类型相同(*T)，
+// 所以RedisStorage不需要newObject，不同类型的Get分开合并
+type BatchLoader struct {
+	Storage
+	wait         time.Duration
+	maxBatchSize int
+
+	lock    sync.Mutex
+	pending map[reflect.Type]*loaderBatch
+}
+
+var keyType = reflect.TypeOf((*Key)(nil)).Elem()
+
+type loaderBatch struct {
+	ctx       context.Context
+	valueType reflect.Type
+	keys      []Key
+	seen      map[Key]struct{}
+	timer     *time.Timer
+
+	// deadline 所有调用方中最晚的deadline，noDeadline表示有调用方没有deadline
+	deadline   time.Time
+	noDeadline bool
+
+	done   chan struct{}
+	values reflect.Value
+	err    error
+}
+
+// NewBatchLoader 第一个Get到达后最多等待wait，或者攒够maxBatchSize个key(<=0时不限制)就发出MultiGet
+func NewBatchLoader(storage Storage, wait time.Duration, maxBatchSize int) *BatchLoader {
+	return &BatchLoader{
+		Storage:      storage,
+		wait:         wait,
+		maxBatchSize: maxBatchSize,
+		pending:      make(map[reflect.Type]*loaderBatch),
+	}
+}
+
+// Get value必须是指针，key不存在时返回EmptyObjectError
+func (this *BatchLoader) Get(ctx context.Context, key Key, value interface{}) error {
+	valueType := reflect.TypeOf(value)
+	if valueType == nil || valueType.Kind() != reflect.Ptr {
+		return this.Storage.Get(ctx, key, value)
+	}
+
+	batch := this.enqueue(ctx, key, valueType)
+	select {
+	case <-batch.done:
+	case <-ctx.Done():
+		return redisError(ctx.Err())
+	}
+	// MultiGet部分失败时已经取到的key仍然返回结果
+	result := batch.values.MapIndex(reflect.ValueOf(key))
+	if result.IsValid() && !result.IsNil() {
+		reflect.ValueOf(value).Elem().Set(result.Elem())
+		return nil
+	}
+	// 部分失败时只返回这个key的KeyError
+	if multiErr, ok := batch.err.(*MultiError); ok {
+		for _, keyErr := range multiErr.Errors {
+			if keyErr.Key == key {
+				return keyErr
+			}
+		}
+	} else if batch.err != nil {
+		return batch.err
+	}
+	return EmptyObjectError{key.String()}
+}
+
+func (this *BatchLoader) enqueue(ctx context.Context, key Key, valueType reflect.Type) *loaderBatch {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	batch, ok := this.pending[valueType]
+	if !ok {
+		batch = &loaderBatch{
+			// 每个调用方各自等待自己的ctx，MultiGet不因为第一个调用方取消而失败，
+			// 超时时间使用所有调用方中最晚的deadline
+			ctx:       context.WithoutCancel(ctx),
+			valueType: valueType,
+			seen:      make(map[Key]struct{}),
+			done:      make(chan struct{}),
+		}
+		this.pending[valueType] = batch
+		batch.timer = time.AfterFunc(this.wait, func() { this.dispatch(batch) })
+	}
+	if deadline, ok := ctx.Deadline(); !ok {
+		batch.noDeadline = true
+	} else if deadline.After(batch.deadline) {
+		batch.deadline = deadline
+	}
+	if _, ok := batch.seen[key]; !ok {
+		batch.seen[key] = struct{}{}
+		batch.keys = append(batch.keys, key)
+	}
+	if this.maxBatchSize > 0 && len(batch.keys) >= this.maxBatchSize && batch.timer.Stop() {
+		delete(this.pending, valueType)
+		go this.dispatch(batch)
+	}
+	return batch
+}
+
+// dispatch 每个batch只会执行一次：timer触发和攒满两条路径中只有Stop成功的一方会调用
+func (this *BatchLoader) dispatch(batch *loaderBatch) {
+	this.lock.Lock()
+	if this.pending[batch.valueType] == batch {
+		delete(this.pending, batch.valueType)
+	}
+	ctx := batch.ctx
+	if !batch.noDeadline {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, batch.deadline)
+		defer cancel()
+	}
+	this.lock.Unlock()
+
+	valuesMap := reflect.MakeMap(reflect.MapOf(keyType, batch.valueType))
+	batch.err = this.Storage.MultiGet(ctx, batch.keys, valuesMap.Interface())
+	batch.values = valuesMap
+	close(batch.done)
+}
@@ -0,0 +1,165 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type countingStorage struct {
+	Storage
+	multiGets int32
+}
+
+func (this *countingStorage) MultiGet(ctx context.Context, keys []Key, valuesMap interface{}) error {
+	atomic.AddInt32(&this.multiGets, 1)
+	return this.Storage.MultiGet(ctx, keys, valuesMap)
+}
+
+func TestBatchLoader(t *testing.T) {
+	ctx := context.Background()
+	redisStorage := NewRedisStorage(newMockRedisClient(), "loader", 0, JsonEncoding{}, nil, false)
+	for i := 0; i < 8; i++ {
+		redisStorage.Set(ctx, Int(i), typedStorageUser{Id: int64(i)})
+	}
+	storage := &countingStorage{Storage: redisStorage}
+	loader := NewBatchLoader(storage, 20*time.Millisecond, 5)
+
+	var wg sync.WaitGroup
+	errs := make([]error, 10)
+	users := make([]typedStorageUser, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = loader.Get(ctx, Int(i), &users[i])
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < 10; i++ {
+		if i < 8 && (errs[i] != nil || users[i].Id != int64(i)) {
+			t.Errorf("key %d should be loaded, user=%+v err=%v", i, users[i], errs[i])
+		}
+		if i >= 8 && !IsErrorEmpty(errs[i]) {
+			t.Errorf("key %d should be missing, err=%v", i, errs[i])
+		}
+	}
+	if n := atomic.LoadInt32(&storage.multiGets); n != 2 {
+		t.Errorf("10 gets with max batch size 5 should be 2 MultiGets, got %d", n)
+	}
+}
+
+func TestBatchLoaderCanceled(t *testing.T) {
+	redisStorage := NewRedisStorage(newMockRedisClient(), "loader", 0, JsonEncoding{}, nil, false)
+	redisStorage.Set(context.Background(), Int(1), typedStorageUser{Id: 1})
+	loader := NewBatchLoader(redisStorage, 50*time.Millisecond, 0)
+
+	canceledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var canceledUser, user typedStorageUser
+	var wg sync.WaitGroup
+	var canceledErr, err error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		canceledErr = loader.Get(canceledCtx, Int(1), &canceledUser)
+	}()
+	go func() {
+		defer wg.Done()
+		err = loader.Get(context.Background(), Int(1), &user)
+	}()
+	wg.Wait()
+
+	if !errors.Is(canceledErr, context.Canceled) {
+		t.Errorf("canceled get should return context.Canceled, got %v", canceledErr)
+	}
+	// 一个调用方取消不影响同一批次的其它调用方
+	if err != nil || user.Id != 1 {
+		t.Errorf("get should not be affected by other canceled caller, user=%+v err=%v", user, err)
+	}
+}
+
+func TestBatchLoaderPartialFailure(t *testing.T) {
+	ctx := context.Background()
+	client := newMockRedisClient()
+	redisStorage := NewRedisStorage(client, "loader", 0, JsonEncoding{}, nil, false)
+	redisStorage.Set(ctx, Int(1), typedStorageUser{Id: 1})
+	client.values["loader_2"] = "{bad json"
+	client.values["loader_3"] = "{bad json"
+	loader := NewBatchLoader(redisStorage, 20*time.Millisecond, 0)
+
+	var wg sync.WaitGroup
+	errs := make([]error, 5)
+	users := make([]typedStorageUser, 5)
+	for i := 1; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = loader.Get(ctx, Int(i), &users[i])
+		}(i)
+	}
+	wg.Wait()
+
+	if errs[1] != nil || users[1].Id != 1 {
+		t.Errorf("key 1 should be loaded, user=%+v err=%v", users[1], errs[1])
+	}
+	for _, i := range []int{2, 3} {
+		keyErr, ok := errs[i].(KeyError)
+		if !ok || keyErr.Key != Int(i) || !errors.Is(errs[i], ErrDecode) {
+			t.Errorf("key %d should get its own KeyError, got %v", i, errs[i])
+		}
+	}
+	if !IsErrorEmpty(errs[4]) {
+		t.Errorf("missing key should be EmptyObjectError even if other keys failed, got %v", errs[4])
+	}
+}
+
+// deadlineStorage 记录MultiGet收到的ctx的deadline
+type deadlineStorage struct {
+	Storage
+	deadline    time.Time
+	hasDeadline bool
+}
+
+func (this *deadlineStorage) MultiGet(ctx context.Context, keys []Key, valuesMap interface{}) error {
+	this.deadline, this.hasDeadline = ctx.Deadline()
+	return this.Storage.MultiGet(ctx, keys, valuesMap)
+}
+
+func TestBatchLoaderDeadline(t *testing.T) {
+	redisStorage := NewRedisStorage(newMockRedisClient(), "loader", 0, JsonEncoding{}, nil, false)
+	storage := &deadlineStorage{Storage: redisStorage}
+	loader := NewBatchLoader(storage, 20*time.Millisecond, 0)
+
+	load := func(ctxs ...context.Context) {
+		var wg sync.WaitGroup
+		for i, ctx := range ctxs {
+			wg.Add(1)
+			go func(i int, ctx context.Context) {
+				defer wg.Done()
+				var user typedStorageUser
+				loader.Get(ctx, Int(i), &user)
+			}(i, ctx)
+		}
+		wg.Wait()
+	}
+
+	ctx1, cancel1 := context.WithTimeout(context.Background(), time.Second)
+	defer cancel1()
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel2()
+	load(ctx1, ctx2)
+	latest, _ := ctx2.Deadline()
+	if !storage.hasDeadline || !storage.deadline.Equal(latest) {
+		t.Errorf("MultiGet should use the latest deadline %v, got %v %v", latest, storage.deadline, storage.hasDeadline)
+	}
+
+	load(ctx1, context.Background())
+	if storage.hasDeadline {
+		t.Errorf("MultiGet should have no deadline when a caller has none, got %v", storage.deadline)
+	}
+}
@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// shardedMockRedisClient 按key的最后一个字符分shard，记录每次MGet的key，failShard的MGet返回错误
+type shardedMockRedisClient struct {
+	*mockRedisClient
+	failShard int
+
+	lock  sync.Mutex
+	mgets [][]string
+}
+
+func (this *shardedMockRedisClient) ShardOf(key string) int {
+	return int(key[len(key)-1]) % 2
+}
+
+func (this *shardedMockRedisClient) MGet(ctx context.Context, keys ...string) ([]interface{}, error) {
+	this.lock.Lock()
+	this.mgets = append(this.mgets, keys)
+	this.lock.Unlock()
+	if this.ShardOf(keys[0]) == this.failShard {
+		return nil, errors.New("shard unavailable")
+	}
+	return this.mockRedisClient.MGet(ctx, keys...)
+}
+
+func TestBatchOptionsSplit(t *testing.T) {
+	client := &shardedMockRedisClient{mockRedisClient: newMockRedisClient(), failShard: -1}
+	batches := BatchOptions{BatchSize: 2}.split(client, []string{"a0", "a1", "a2", "a3", "a4"})
+	if len(batches) != 3 {
+		t.Fatalf("expected 3 batches, got %v", batches)
+	}
+	for _, batch := range batches {
+		if len(batch) > 2 {
+			t.Errorf("batch larger than BatchSize: %v", batch)
+		}
+	}
+
+	batches = BatchOptions{BatchSize: 2}.split(newMockRedisClient(), []string{"a0", "a1", "a2"})
+	if len(batches) != 2 || len(batches[0]) != 2 || batches[1][0] != 2 {
+		t.Errorf("unsharded split mismatch, batches=%v", batches)
+	}
+}
+
+func TestRedisStorageBatchMultiGet(t *testing.T) {
+	ctx := context.Background()
+	client := &shardedMockRedisClient{mockRedisClient: newMockRedisClient(), failShard: -1}
+	storage := NewRedisStorage(client, "batch", 0, JsonEncoding{}, func() interface{} { return new(string) }, false)
+	storage.Batch = BatchOptions{BatchSize: 3, Parallelism: 4}
+
+	keys := make([]Key, 20)
+	valueMap := make(map[Key]interface{})
+	for i := range keys {
+		keys[i] = Int(i)
+		valueMap[keys[i]] = strings.Repeat("x", i)
+	}
+	if err := storage.MultiSet(ctx, valueMap); err != nil {
+		t.Fatal(err)
+	}
+
+	values := make(map[Key]*string)
+	if err := storage.MultiGet(ctx, keys, values); err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != len(keys) {
+		t.Errorf("expected %d values, got %d", len(keys), len(values))
+	}
+	for _, mget := range client.mgets {
+		if len(mget) > 3 {
+			t.Errorf("mget larger than BatchSize: %v", mget)
+		}
+	}
+
+	client.failShard = 1
+	values = make(map[Key]*string)
+	err := storage.MultiGet(ctx, keys, values)
+	multiErr, ok := err.(*MultiError)
+	if !ok {
+		t.Fatalf("expected MultiError, got %v", err)
+	}
+	if len(multiErr.Errors) != 10 || multiErr.Errors[0].Stage != StageRedis {
+		t.Errorf("keys of failed shard should be reported, got %v", multiErr.Errors)
+	}
+	if len(values) != 10 {
+		t.Errorf("values of healthy shard should be returned, got %d", len(values))
+	}
+
+	results, err := storage.MultiGetSlice(ctx, keys, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, result := range results {
+		if failed := i%2 == 1; failed != (result.Err != nil) || failed == result.Found {
+			t.Errorf("key %d result mismatch: %+v", i, result)
+		}
+	}
+
+	if err := storage.Delete(ctx, keys...); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.values) != 0 {
+		t.Errorf("all keys should be deleted, %d left", len(client.values))
+	}
+}
@@ -0,0 +1,230 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+// 超过RedisStorage.ChunkSize的value被拆成多个chunk key，原来的key中只保存manifest。
+// 每次写入使用新的generation，chunk key中带有generation，
+// 所以先写chunk再写manifest，读到的manifest指向的chunk一定是同一次写入的。
+// 旧generation的chunk在新manifest写入后删除，chunk的过期时间比manifest稍长，
+// Touch和SlidingExpiration刷新manifest时同时刷新chunk。
+//
+// 并发Set同一个key时，manifest被覆盖的一方的chunk不会被删除，只能等过期，
+// 所以打开ChunkSize时应该设置DefaultExpireTime，否则这些chunk会一直保留。
+//
+// manifest layout: envelope(flags=chunked) | generation(8) | chunkCount(uvarint) | size(uvarint)
+
+const chunkKeySeparator = "~chunk~"
+
+// chunkExpireMargin chunk比manifest多保留的时间，避免manifest还在chunk已经过期
+const chunkExpireMargin = time.Minute
+
+type chunkManifest struct {
+	generation uint64
+	count      int
+	size       int
+}
+
+func isChunkKey(cacheKey string) bool {
+	return strings.Contains(cacheKey, chunkKeySeparator)
+}
+
+func chunkKey(cacheKey string, generation uint64, index int) string {
+	return fmt.Sprintf("%s%s%x~%d", cacheKey, chunkKeySeparator, generation, index)
+}
+
+func (this chunkManifest) keys(cacheKey string) []string {
+	keys := make([]string, this.count)
+	for i := range keys {
+		keys[i] = chunkKey(cacheKey, this.generation, i)
+	}
+	return keys
+}
+
+func packChunkManifest(manifest chunkManifest) []byte {
+	payload := make([]byte, 8, 8+2*binary.MaxVarintLen64)
+	binary.BigEndian.PutUint64(payload, manifest.generation)
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], uint64(manifest.count))
+	payload = append(payload, buf[:n]...)
+	n = binary.PutUvarint(buf[:], uint64(manifest.size))
+	payload = append(payload, buf[:n]...)
+	return packEnvelope(envelope{flags: envelopeFlagChunked, payload: payload})
+}
+
+// unpackChunkManifest data不是manifest时ok为false
+func unpackChunkManifest(data []byte) (manifest chunkManifest, ok bool, err error) {
+	if !isEnveloped(data) || data[2]&envelopeFlagChunked == 0 {
+		return manifest, false, nil
+	}
+	env, err := unpackEnvelope(data)
+	if err != nil {
+		return manifest, true, err
+	}
+	payload := env.payload
+	if len(payload) < 8 {
+		return manifest, true, CorruptValueError{Reason: "chunk manifest truncated"}
+	}
+	manifest.generation = binary.BigEndian.Uint64(payload)
+	payload = payload[8:]
+	count, n := binary.Uvarint(payload)
+	if n <= 0 {
+		return manifest, true, CorruptValueError{Reason: "chunk manifest count invalid"}
+	}
+	payload = payload[n:]
+	size, n := binary.Uvarint(payload)
+	if n <= 0 {
+		return manifest, true, CorruptValueError{Reason: "chunk manifest size invalid"}
+	}
+	manifest.count = int(count)
+	manifest.size = int(size)
+	return manifest, true, nil
+}
+
+func newChunkGeneration() uint64 {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return uint64(time.Now().UnixNano())
+	}
+	return binary.BigEndian.Uint64(buf[:])
+}
+
+func (this RedisStorage) chunkExpireTime() time.Duration {
+	if this.DefaultExpireTime <= 0 {
+		return 0
+	}
+	return this.DefaultExpireTime + chunkExpireMargin
+}
+
+// splitChunks 返回替代buf写入cacheKey的manifest，以及需要MSet的chunk key/value
+func (this RedisStorage) splitChunks(cacheKey string, buf []byte) (manifest []byte, pairs []interface{}) {
+	m := chunkManifest{
+		generation: newChunkGeneration(),
+		count:      (len(buf) + this.ChunkSize - 1) / this.ChunkSize,
+		size:       len(buf),
+	}
+	pairs = make([]interface{}, 0, 2*m.count)
+	for i, key := range m.keys(cacheKey) {
+		end := (i + 1) * this.ChunkSize
+		if end > len(buf) {
+			end = len(buf)
+		}
+		pairs = append(pairs, []byte(key), buf[i*this.ChunkSize:end])
+	}
+	return packChunkManifest(m), pairs
+}
+
+// assembleChunks 把values中的manifest替换成拼接好的value，
+// chunk缺失或manifest损坏时对应位置为nil(当作miss)
+func (this RedisStorage) assembleChunks(ctx context.Context, cacheKeys []string, values [][]byte) ([][]byte, error) {
+	var indexes []int
+	var manifests []chunkManifest
+	var keys []string
+	for i, data := range values {
+		if data == nil {
+			continue
+		}
+		manifest, ok, err := unpackChunkManifest(data)
+		if !ok {
+			continue
+		}
+		if err != nil {
+			log.Warningf("corrupt chunk manifest ,cachekey=%s err=%v", cacheKeys[i], err)
+			values[i] = nil
+			continue
+		}
+		indexes = append(indexes, i)
+		manifests = append(manifests, manifest)
+		keys = append(keys, manifest.keys(cacheKeys[i])...)
+	}
+	if len(keys) == 0 {
+		return values, nil
+	}
+
+	get := this.client.MGet
+	if this.isSliding() {
+		get = func(ctx context.Context, keys ...string) ([]interface{}, error) {
+			return this.client.MGetExpire(ctx, this.chunkExpireTime(), keys...)
+		}
+	}
+	chunks, keyErrs := this.Batch.mget(ctx, this.client, keys, get)
+	if err := firstError(keyErrs); err != nil {
+		return nil, wrapError(err, "redis get chunks error")
+	}
+	offset := 0
+	for j, i := range indexes {
+		manifest := manifests[j]
+		data := make([]byte, 0, manifest.size)
+		for _, chunk := range chunks[offset : offset+manifest.count] {
+			if chunk == nil {
+				data = nil
+				break
+			}
+			data = append(data, chunk.(string)...)
+		}
+		offset += manifest.count
+		if data != nil && len(data) != manifest.size {
+			log.Warningf("chunk size mismatch ,cachekey=%s size=%d expected=%d", cacheKeys[i], len(data), manifest.size)
+			data = nil
+		}
+		values[i] = data
+	}
+	return values, nil
+}
+
+// chunkKeysOf 返回cacheKeys当前manifest指向的chunk key，用于覆盖写和删除时清理
+func (this RedisStorage) chunkKeysOf(ctx context.Context, cacheKeys []string) ([]string, error) {
+	if len(cacheKeys) == 0 {
+		return nil, nil
+	}
+	values, keyErrs := this.Batch.mget(ctx, this.client, cacheKeys, this.client.MGet)
+	if err := firstError(keyErrs); err != nil {
+		return nil, wrapError(err, "redis get error")
+	}
+	var keys []string
+	for i, value := range values {
+		if value == nil {
+			continue
+		}
+		manifest, ok, err := unpackChunkManifest([]byte(value.(string)))
+		if !ok || err != nil {
+			continue
+		}
+		keys = append(keys, manifest.keys(cacheKeys[i])...)
+	}
+	return keys, nil
+}
+
+// touchChunks 把cacheKey当前manifest指向的chunk的过期时间刷新为ttl加上chunkExpireMargin
+func (this RedisStorage) touchChunks(ctx context.Context, cacheKey string, ttl time.Duration) error {
+	keys, err := this.chunkKeysOf(ctx, []string{cacheKey})
+	if err != nil {
+		return err
+	}
+	if ttl > 0 {
+		ttl += chunkExpireMargin
+	}
+	for _, key := range keys {
+		if _, err := this.client.Expire(ctx, key, ttl); err != nil {
+			return wrapErrorf(err, "redis expire chunk error key is %s", key)
+		}
+	}
+	return nil
+}
+
+func (this RedisStorage) deleteChunks(ctx context.Context, keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+	if _, keyErrs := this.Batch.del(ctx, this.client, keys); keyErrs != nil {
+		log.Warningf("delete old chunks error ,count=%d err=%v", len(keys), firstError(keyErrs))
+	}
+}
@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestRedisStorageChunks(t *testing.T) {
+	ctx := context.Background()
+	client := newMockRedisClient()
+	storage := NewRedisStorage(client, "chunk", 0, JsonEncoding{}, func() interface{} { return new(string) }, false)
+	storage.ChunkSize = 16
+
+	value := strings.Repeat("abcdefgh", 10)
+	if err := storage.Set(ctx, String("1"), value); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.values) != 1+6 {
+		t.Errorf("value should be stored as manifest and 6 chunks, got %d keys", len(client.values))
+	}
+
+	var result string
+	if err := storage.Get(ctx, String("1"), &result); err != nil || result != value {
+		t.Errorf("get chunked value failed, result=%q err=%v", result, err)
+	}
+
+	values := make(map[Key]*string)
+	if err := storage.MultiGet(ctx, []Key{String("1"), String("2")}, values); err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 1 || *values[String("1")] != value {
+		t.Errorf("multi get chunked value failed, values=%v", values)
+	}
+
+	// 覆盖写成小value后旧chunk被清理
+	if err := storage.Set(ctx, String("1"), "small"); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.values) != 1 {
+		t.Errorf("old chunks should be deleted, got %d keys", len(client.values))
+	}
+
+	if err := storage.Set(ctx, String("1"), value); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Delete(ctx, String("1")); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.values) != 0 {
+		t.Errorf("chunks should be deleted with manifest, got %d keys", len(client.values))
+	}
+}
+
+func serverChunkKeys(server *miniredis.Miniredis, cacheKey string) []string {
+	var keys []string
+	for _, key := range server.Keys() {
+		if strings.HasPrefix(key, cacheKey+chunkKeySeparator) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func TestRedisStorageChunksExpire(t *testing.T) {
+	ctx := context.Background()
+	server, client := newMiniRedisClient(t)
+	storage := NewRedisStorage(client, "chunk", 10*time.Minute, JsonEncoding{}, func() interface{} { return new(string) }, false)
+	storage.ChunkSize = 16
+	value := strings.Repeat("abcdefgh", 10)
+	if err := storage.Set(ctx, String("1"), value); err != nil {
+		t.Fatal(err)
+	}
+	chunks := serverChunkKeys(server, "chunk_1")
+	if len(chunks) != 6 {
+		t.Fatalf("value should be stored as 6 chunks, got %v", chunks)
+	}
+
+	// Touch之后manifest和chunk都不能比ttl先过期
+	if err := storage.Touch(ctx, String("1"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range chunks {
+		if ttl := server.TTL(key); ttl != time.Hour+chunkExpireMargin {
+			t.Errorf("touch should refresh chunk %s ttl, got %v", key, ttl)
+		}
+	}
+	server.FastForward(30 * time.Minute)
+	var result string
+	if err := storage.Get(ctx, String("1"), &result); err != nil || result != value {
+		t.Errorf("touched value should outlive default expire, result=%q err=%v", result, err)
+	}
+
+	// SlidingExpiration读取时刷新chunk
+	storage.SlidingExpiration = true
+	server.FastForward(29 * time.Minute)
+	if err := storage.Get(ctx, String("1"), &result); err != nil || result != value {
+		t.Fatalf("get error result=%q err=%v", result, err)
+	}
+	for _, key := range chunks {
+		if ttl := server.TTL(key); ttl != storage.chunkExpireTime() {
+			t.Errorf("sliding get should refresh chunk %s ttl, got %v", key, ttl)
+		}
+	}
+	server.FastForward(9 * time.Minute)
+	if err := storage.Get(ctx, String("1"), &result); err != nil || result != value {
+		t.Errorf("sliding value should not lose its chunks, result=%q err=%v", result, err)
+	}
+}
+
+// 并发Set时manifest被覆盖的一方的chunk只能等过期，见chunk.go
+func TestRedisStorageChunksConcurrentSetOrphans(t *testing.T) {
+	ctx := context.Background()
+	server, client := newMiniRedisClient(t)
+	storage := NewRedisStorage(client, "chunk", 10*time.Minute, JsonEncoding{}, func() interface{} { return new(string) }, false)
+	storage.ChunkSize = 16
+	value := strings.Repeat("abcdefgh", 10)
+
+	// 模拟输掉的一方：chunk已经写入，manifest被另一方覆盖
+	buf, err := storage.encode("chunk_1", strings.Repeat("12345678", 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, orphans := storage.splitChunks("chunk_1", buf)
+	if err := client.MSet(ctx, storage.chunkExpireTime(), orphans...); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Set(ctx, String("1"), value); err != nil {
+		t.Fatal(err)
+	}
+	if keys := serverChunkKeys(server, "chunk_1"); len(keys) != 12 {
+		t.Fatalf("orphan chunks should be left until they expire, got %d chunk keys", len(keys))
+	}
+	var result string
+	if err := storage.Get(ctx, String("1"), &result); err != nil || result != value {
+		t.Errorf("orphan chunks should not affect the value, result=%q err=%v", result, err)
+	}
+	for i := 0; i < len(orphans); i += 2 {
+		if ttl := server.TTL(string(orphans[i].([]byte))); ttl != storage.chunkExpireTime() {
+			t.Errorf("orphan chunk should expire with chunk expire time, got %v", ttl)
+		}
+	}
+}
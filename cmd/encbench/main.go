@@ -0,0 +1,252 @@
+// encbench 用样本数据评估所有注册的Encoding，输出大小、压缩比、序列化/反序列化耗时和内存分配，
+// 并为每个prefix推荐一个Encoding。
+//
+// 样本来源:
+//
+//	encbench -file samples.jsonl                     # 每行一个json value
+//	encbench -redis 127.0.0.1:6379 -prefix user,feed # 从redis中采样，用-source-encoding解码
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"text/tabwriter"
+
+	"github.com/1024casts/storage"
+	"github.com/go-redis/redis"
+)
+
+var (
+	file           = flag.String("file", "", "jsonl file, one sample value per line")
+	redisAddr      = flag.String("redis", "", "redis address to sample values from")
+	prefixes       = flag.String("prefix", "", "comma separated key prefixes to sample from redis, or the label of -file samples")
+	sourceEncoding = flag.String("source-encoding", "json", "registered encoding name of values in redis")
+	sampleCount    = flag.Int("count", 1000, "max samples per prefix")
+	prefer         = flag.String("prefer", "balanced", "recommend by size, speed or balanced")
+)
+
+type result struct {
+	name          string
+	err           error
+	size          int
+	marshalNs     float64
+	unmarshalNs   float64
+	marshalAllocs float64
+	unmarshalAllc float64
+}
+
+func init() {
+	// json解码出来的样本是map[string]interface{}和[]interface{}，gob需要注册后才能编码
+	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+}
+
+func main() {
+	flag.Parse()
+	if *file == "" && *redisAddr == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if *file != "" {
+		samples, err := readJSONL(*file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		label := *prefixes
+		if label == "" {
+			label = *file
+		}
+		report(label, samples)
+		return
+	}
+
+	source, ok := storage.GetEncodingByName(*sourceEncoding)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown source encoding %s\n", *sourceEncoding)
+		os.Exit(2)
+	}
+	client := storage.NewRedisClient(redis.NewClient(&redis.Options{Addr: *redisAddr}))
+	storage.SetLogFlag(0)
+	for _, prefix := range strings.Split(*prefixes, ",") {
+		if prefix == "" {
+			continue
+		}
+		samples, err := readRedis(client, prefix, source)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "sample prefix %s error %v\n", prefix, err)
+			continue
+		}
+		report(prefix, samples)
+	}
+}
+
+func readJSONL(path string) ([]interface{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var samples []interface{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+	for scanner.Scan() && len(samples) < *sampleCount {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var value interface{}
+		if err := json.Unmarshal([]byte(line), &value); err != nil {
+			return nil, fmt.Errorf("line %d: %v", len(samples)+1, err)
+		}
+		// null没有类型，无法unmarshal回去
+		if value == nil {
+			continue
+		}
+		samples = append(samples, value)
+	}
+	return samples, scanner.Err()
+}
+
+func readRedis(client storage.RedisClient, prefix string, source storage.Encoding) ([]interface{}, error) {
+	redisStorage := storage.NewRedisStorage(client, prefix, 0, source, nil, false)
+	payloads, err := redisStorage.SampleValues(context.Background(), *sampleCount)
+	if err != nil {
+		return nil, err
+	}
+	samples := make([]interface{}, 0, len(payloads))
+	for _, payload := range payloads {
+		var value interface{}
+		if err := source.Unmarshal(payload, &value); err != nil || value == nil {
+			continue
+		}
+		samples = append(samples, value)
+	}
+	return samples, nil
+}
+
+func bench(e storage.Encoding, samples []interface{}) result {
+	r := result{}
+	encoded := make([][]byte, len(samples))
+	for i, sample := range samples {
+		if sample == nil {
+			r.err = fmt.Errorf("sample %d is null", i)
+			return r
+		}
+		data, err := e.Marshal(sample)
+		if err != nil {
+			r.err = err
+			return r
+		}
+		target := reflect.New(reflect.TypeOf(sample))
+		if err = e.Unmarshal(data, target.Interface()); err != nil {
+			r.err = err
+			return r
+		}
+		encoded[i] = data
+		r.size += len(data)
+	}
+
+	marshal := testing.Benchmark(func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			for _, sample := range samples {
+				e.Marshal(sample)
+			}
+		}
+	})
+	unmarshal := testing.Benchmark(func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			for i, data := range encoded {
+				e.Unmarshal(data, reflect.New(reflect.TypeOf(samples[i])).Interface())
+			}
+		}
+	})
+	count := float64(len(samples))
+	r.marshalNs = float64(marshal.NsPerOp()) / count
+	r.unmarshalNs = float64(unmarshal.NsPerOp()) / count
+	r.marshalAllocs = float64(marshal.AllocsPerOp()) / count
+	r.unmarshalAllc = float64(unmarshal.AllocsPerOp()) / count
+	return r
+}
+
+func report(prefix string, samples []interface{}) {
+	if len(samples) == 0 {
+		fmt.Printf("%s: no samples\n\n", prefix)
+		return
+	}
+	var baseline int
+	for _, sample := range samples {
+		data, _ := json.Marshal(sample)
+		baseline += len(data)
+	}
+
+	var results []result
+	for _, registered := range storage.RegisteredEncodings() {
+		r := bench(registered.Encoding, samples)
+		r.name = registered.Name
+		results = append(results, r)
+	}
+
+	fmt.Printf("%s: %d samples, %d bytes as json\n", prefix, len(samples), baseline)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "encoding\tavg size\tratio\tmarshal ns\tunmarshal ns\tmarshal allocs\tunmarshal allocs\t")
+	var supported []result
+	for _, r := range results {
+		if r.err != nil {
+			continue
+		}
+		supported = append(supported, r)
+		fmt.Fprintf(w, "%s\t%d\t%.2f\t%.0f\t%.0f\t%.1f\t%.1f\t\n",
+			r.name, r.size/len(samples), float64(baseline)/float64(r.size),
+			r.marshalNs, r.unmarshalNs, r.marshalAllocs, r.unmarshalAllc)
+	}
+	w.Flush()
+	for _, r := range results {
+		if r.err != nil {
+			fmt.Printf("  %s unsupported: %v\n", r.name, r.err)
+		}
+	}
+	if len(supported) > 0 {
+		best := recommend(supported)
+		fmt.Printf("recommended for %s: %s\n", prefix, best.name)
+	}
+	fmt.Println()
+}
+
+// recommend 按-prefer选择Encoding，balanced时取大小和读写耗时(都相对最小值归一化)乘积最小的
+func recommend(results []result) result {
+	minSize, minNs := math.MaxFloat64, math.MaxFloat64
+	for _, r := range results {
+		minSize = math.Min(minSize, float64(r.size))
+		minNs = math.Min(minNs, r.marshalNs+r.unmarshalNs)
+	}
+	score := func(r result) float64 {
+		size := float64(r.size) / minSize
+		ns := (r.marshalNs + r.unmarshalNs) / minNs
+		switch *prefer {
+		case "size":
+			return size
+		case "speed":
+			return ns
+		default:
+			return size * ns
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return score(results[i]) < score(results[j])
+	})
+	return results[0]
+}
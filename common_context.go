@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"context"
+
+	commoncontext "github.com/1024casts/go-common/context"
+)
+
+type commonContextKey struct{}
+
+// WithCommonContext 把go-common的*context.Context放进标准库的ctx，用CommonContextFrom取出
+func WithCommonContext(parent context.Context, commonCtx *commoncontext.Context) context.Context {
+	if parent == nil {
+		parent = context.Background()
+	}
+	return context.WithValue(parent, commonContextKey{}, commonCtx)
+}
+
+// CommonContextFrom 返回WithCommonContext放入的go-common context，没有时返回nil
+func CommonContextFrom(ctx context.Context) *commoncontext.Context {
+	if ctx == nil {
+		return nil
+	}
+	commonCtx, _ := ctx.Value(commonContextKey{}).(*commoncontext.Context)
+	return commonCtx
+}
+
+// LegacyStorage 是使用go-common context的旧版Storage接口
+type LegacyStorage interface {
+	Get(ctx *commoncontext.Context, key Key, value interface{}) error
+	Set(ctx *commoncontext.Context, key Key, object interface{}) error
+	Add(ctx *commoncontext.Context, key Key, object interface{}) error
+	MultiGet(ctx *commoncontext.Context, keys []Key, valuesMap interface{}) error
+	MultiSet(ctx *commoncontext.Context, values map[Key]interface{}) error
+	Delete(ctx *commoncontext.Context, key ...Key) error
+}
+
+// NewLegacyStorage 把Storage包装成LegacyStorage，给还在使用go-common context的调用方。
+// go-common context没有deadline和取消，调用不会超时
+func NewLegacyStorage(storage Storage) LegacyStorage {
+	return legacyStorage{storage}
+}
+
+// FromLegacyStorage 把LegacyStorage包装成Storage，比如作为StorageProxy的BackupStorage。
+// 调用前检查ctx是否已经结束，ctx中WithCommonContext放入的go-common context会传给被包装的LegacyStorage
+func FromLegacyStorage(storage LegacyStorage) Storage {
+	return fromLegacyStorage{storage}
+}
+
+type legacyStorage struct {
+	storage Storage
+}
+
+func (this legacyStorage) context(commonCtx *commoncontext.Context) context.Context {
+	return WithCommonContext(context.Background(), commonCtx)
+}
+
+func (this legacyStorage) Get(ctx *commoncontext.Context, key Key, value interface{}) error {
+	return this.storage.Get(this.context(ctx), key, value)
+}
+
+func (this legacyStorage) Set(ctx *commoncontext.Context, key Key, object interface{}) error {
+	return this.storage.Set(this.context(ctx), key, object)
+}
+
+func (this legacyStorage) Add(ctx *commoncontext.Context, key Key, object interface{}) error {
+	return this.storage.Add(this.context(ctx), key, object)
+}
+
+func (this legacyStorage) MultiGet(ctx *commoncontext.Context, keys []Key, valuesMap interface{}) error {
+	return this.storage.MultiGet(this.context(ctx), keys, valuesMap)
+}
+
+func (this legacyStorage) MultiSet(ctx *commoncontext.Context, values map[Key]interface{}) error {
+	return this.storage.MultiSet(this.context(ctx), values)
+}
+
+func (this legacyStorage) Delete(ctx *commoncontext.Context, keys ...Key) error {
+	return this.storage.Delete(this.context(ctx), keys...)
+}
+
+type fromLegacyStorage struct {
+	storage LegacyStorage
+}
+
+func (this fromLegacyStorage) Get(ctx context.Context, key Key, value interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return redisError(err)
+	}
+	return this.storage.Get(CommonContextFrom(ctx), key, value)
+}
+
+func (this fromLegacyStorage) Set(ctx context.Context, key Key, object interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return redisError(err)
+	}
+	return this.storage.Set(CommonContextFrom(ctx), key, object)
+}
+
+func (this fromLegacyStorage) Add(ctx context.Context, key Key, object interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return redisError(err)
+	}
+	return this.storage.Add(CommonContextFrom(ctx), key, object)
+}
+
+func (this fromLegacyStorage) MultiGet(ctx context.Context, keys []Key, valuesMap interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return redisError(err)
+	}
+	return this.storage.MultiGet(CommonContextFrom(ctx), keys, valuesMap)
+}
+
+func (this fromLegacyStorage) MultiSet(ctx context.Context, values map[Key]interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return redisError(err)
+	}
+	return this.storage.MultiSet(CommonContextFrom(ctx), values)
+}
+
+func (this fromLegacyStorage) Delete(ctx context.Context, keys ...Key) error {
+	if err := ctx.Err(); err != nil {
+		return redisError(err)
+	}
+	return this.storage.Delete(CommonContextFrom(ctx), keys...)
+}
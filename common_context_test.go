@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	commoncontext "github.com/1024casts/go-common/context"
+)
+
+// commonContextStorage 记录每次调用收到的go-common context
+type commonContextStorage struct {
+	*mapStorage
+	received []*commoncontext.Context
+}
+
+func (this *commonContextStorage) record(ctx context.Context) {
+	this.received = append(this.received, CommonContextFrom(ctx))
+}
+
+func (this *commonContextStorage) Get(ctx context.Context, key Key, value interface{}) error {
+	this.record(ctx)
+	return this.mapStorage.Get(ctx, key, value)
+}
+
+func (this *commonContextStorage) Set(ctx context.Context, key Key, object interface{}) error {
+	this.record(ctx)
+	return this.mapStorage.Set(ctx, key, object)
+}
+
+func (this *commonContextStorage) Delete(ctx context.Context, keys ...Key) error {
+	this.record(ctx)
+	return this.mapStorage.Delete(ctx, keys...)
+}
+
+// legacyMapStorage 使用go-common context的LegacyStorage，记录收到的context
+type legacyMapStorage struct {
+	values   map[Key]interface{}
+	received []*commoncontext.Context
+}
+
+func (this *legacyMapStorage) Get(ctx *commoncontext.Context, key Key, value interface{}) error {
+	this.received = append(this.received, ctx)
+	if _, ok := this.values[key]; !ok {
+		return EmptyObjectError{key.String()}
+	}
+	return nil
+}
+
+func (this *legacyMapStorage) Set(ctx *commoncontext.Context, key Key, object interface{}) error {
+	this.received = append(this.received, ctx)
+	this.values[key] = object
+	return nil
+}
+
+func (this *legacyMapStorage) Add(ctx *commoncontext.Context, key Key, object interface{}) error {
+	return this.Set(ctx, key, object)
+}
+
+func (this *legacyMapStorage) MultiGet(ctx *commoncontext.Context, keys []Key, valuesMap interface{}) error {
+	this.received = append(this.received, ctx)
+	return nil
+}
+
+func (this *legacyMapStorage) MultiSet(ctx *commoncontext.Context, values map[Key]interface{}) error {
+	this.received = append(this.received, ctx)
+	return nil
+}
+
+func (this *legacyMapStorage) Delete(ctx *commoncontext.Context, keys ...Key) error {
+	this.received = append(this.received, ctx)
+	for _, key := range keys {
+		delete(this.values, key)
+	}
+	return nil
+}
+
+func TestCommonContext(t *testing.T) {
+	commonCtx := &commoncontext.Context{}
+	ctx := WithCommonContext(context.Background(), commonCtx)
+	if CommonContextFrom(ctx) != commonCtx {
+		t.Error("common context should be read back")
+	}
+	if CommonContextFrom(WithCommonContext(nil, commonCtx)) != commonCtx {
+		t.Error("nil parent should be replaced with background")
+	}
+	if CommonContextFrom(context.Background()) != nil || CommonContextFrom(nil) != nil {
+		t.Error("ctx without common context should return nil")
+	}
+}
+
+func TestLegacyStorage(t *testing.T) {
+	storage := &commonContextStorage{mapStorage: &mapStorage{values: map[Key]interface{}{}}}
+	legacy := NewLegacyStorage(storage)
+	commonCtx := &commoncontext.Context{}
+
+	if err := legacy.Set(commonCtx, String("1"), "a"); err != nil {
+		t.Fatal(err)
+	}
+	var value string
+	if err := legacy.Get(commonCtx, String("1"), &value); err != nil {
+		t.Errorf("get should find the key set through legacy storage, err=%v", err)
+	}
+	if err := legacy.Delete(commonCtx, String("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := legacy.Get(nil, String("1"), &value); !IsErrorEmpty(err) {
+		t.Errorf("deleted key should be empty, got %v", err)
+	}
+	expected := []*commoncontext.Context{commonCtx, commonCtx, commonCtx, nil}
+	if len(storage.received) != len(expected) {
+		t.Fatalf("expected %d calls, got %d", len(expected), len(storage.received))
+	}
+	for i := range expected {
+		if storage.received[i] != expected[i] {
+			t.Errorf("call %d should carry the go-common context %p, got %p", i, expected[i], storage.received[i])
+		}
+	}
+}
+
+func TestFromLegacyStorage(t *testing.T) {
+	legacy := &legacyMapStorage{values: map[Key]interface{}{}}
+	storage := FromLegacyStorage(legacy)
+	commonCtx := &commoncontext.Context{}
+	ctx := WithCommonContext(context.Background(), commonCtx)
+
+	if err := storage.Set(ctx, String("1"), "a"); err != nil {
+		t.Fatal(err)
+	}
+	var value string
+	if err := storage.Get(context.Background(), String("1"), &value); err != nil {
+		t.Errorf("get should find the key set through legacy storage, err=%v", err)
+	}
+	if len(legacy.received) != 2 || legacy.received[0] != commonCtx || legacy.received[1] != nil {
+		t.Errorf("go-common context should be passed from ctx, got %v", legacy.received)
+	}
+
+	// ctx已经结束时不调用LegacyStorage
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := storage.Delete(canceledCtx, String("1")); !errors.Is(err, context.Canceled) {
+		t.Errorf("delete with canceled ctx should fail, got %v", err)
+	}
+	if _, ok := legacy.values[String("1")]; !ok || len(legacy.received) != 2 {
+		t.Error("legacy storage should not be called with canceled ctx")
+	}
+}
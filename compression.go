@@ -0,0 +1,392 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+
+	"github.com/dropbox/godropbox/errors"
+	log "github.com/golang/glog"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Compressor 压缩算法，通过CompressEncoding和任意Encoding组合使用
+type Compressor interface {
+	Compress(in []byte) ([]byte, error)
+	Decompress(in []byte) ([]byte, error)
+}
+
+// CompressEncoding 先用Encoding序列化，再用Compressor压缩
+type CompressEncoding struct {
+	Encoding   Encoding
+	Compressor Compressor
+}
+
+func (this CompressEncoding) Marshal(v interface{}) ([]byte, error) {
+	buf, err := this.Encoding.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return this.Compressor.Compress(buf)
+}
+
+func (this CompressEncoding) Unmarshal(data []byte, value interface{}) error {
+	buf, err := this.Compressor.Decompress(data)
+	if err != nil {
+		return err
+	}
+	return this.Encoding.Unmarshal(buf, value)
+}
+
+// BufferDecompressor 由可以解压到调用方提供的buffer的Compressor实现，
+// 返回的数据从buf[:0]开始使用buf的空间，空间不够时重新分配
+type BufferDecompressor interface {
+	DecompressBuffer(buf, in []byte) ([]byte, error)
+}
+
+// UnmarshalString 内层Encoding实现了StringUnmarshaler(不保留输入)时，解压使用复用的buffer
+func (this CompressEncoding) UnmarshalString(data string, value interface{}) error {
+	decompressor, ok := this.Compressor.(BufferDecompressor)
+	inner, innerOk := this.Encoding.(StringUnmarshaler)
+	if !ok || !innerOk {
+		return this.Unmarshal([]byte(data), value)
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	out, err := decompressor.DecompressBuffer(*buf, stringBytes(data))
+	if err != nil {
+		return err
+	}
+	*buf = out
+	return inner.UnmarshalString(bytesString(out), value)
+}
+
+// AdaptiveCompressEncoding 只压缩序列化后超过Threshold字节的数据，
+// 压缩后没有变小时保存原始数据，第一个字节标记数据是否经过压缩
+type AdaptiveCompressEncoding struct {
+	Encoding   Encoding
+	Compressor Compressor
+	Threshold  int
+	// Stats 不为nil时统计压缩比，多个Encoding可以共用一个Stats
+	Stats *CompressionStats
+	// LogRatio 为true时每次压缩都打印压缩比
+	LogRatio bool
+}
+
+const (
+	adaptiveFlagRaw byte = iota
+	adaptiveFlagCompressed
+)
+
+func (this AdaptiveCompressEncoding) Marshal(v interface{}) ([]byte, error) {
+	buf, err := this.Encoding.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) < this.Threshold {
+		this.Stats.add(len(buf), len(buf), false)
+		return append([]byte{adaptiveFlagRaw}, buf...), nil
+	}
+	compressed, err := this.Compressor.Compress(buf)
+	if err != nil {
+		return nil, err
+	}
+	if this.LogRatio {
+		log.Infof("adaptive_compress_ratio=%d/%d=%.2f", len(buf), len(compressed), float64(len(buf))/float64(len(compressed)))
+	}
+	if len(compressed) >= len(buf) {
+		this.Stats.add(len(buf), len(buf), false)
+		return append([]byte{adaptiveFlagRaw}, buf...), nil
+	}
+	this.Stats.add(len(buf), len(compressed), true)
+	return append([]byte{adaptiveFlagCompressed}, compressed...), nil
+}
+
+func (this AdaptiveCompressEncoding) Unmarshal(data []byte, value interface{}) error {
+	if len(data) == 0 {
+		return errors.New("adaptive compress data is empty")
+	}
+	switch data[0] {
+	case adaptiveFlagRaw:
+		return this.Encoding.Unmarshal(data[1:], value)
+	case adaptiveFlagCompressed:
+		buf, err := this.Compressor.Decompress(data[1:])
+		if err != nil {
+			return err
+		}
+		return this.Encoding.Unmarshal(buf, value)
+	default:
+		return errors.Newf("unknown adaptive compress flag %d", data[0])
+	}
+}
+
+// CompressionStats 统计AdaptiveCompressEncoding的压缩情况，可以并发使用
+type CompressionStats struct {
+	total         int64
+	compressed    int64
+	bytesIn       int64
+	bytesOut      int64
+	compressedIn  int64
+	compressedOut int64
+}
+
+func (this *CompressionStats) add(in, out int, compressed bool) {
+	if this == nil {
+		return
+	}
+	atomic.AddInt64(&this.total, 1)
+	atomic.AddInt64(&this.bytesIn, int64(in))
+	atomic.AddInt64(&this.bytesOut, int64(out))
+	if compressed {
+		atomic.AddInt64(&this.compressed, 1)
+		atomic.AddInt64(&this.compressedIn, int64(in))
+		atomic.AddInt64(&this.compressedOut, int64(out))
+	}
+}
+
+type CompressionStatsSnapshot struct {
+	Total         int64 // Marshal次数
+	Compressed    int64 // 其中保存为压缩数据的次数
+	BytesIn       int64 // 压缩前总字节数
+	BytesOut      int64 // 保存的总字节数(不含flag)
+	CompressedIn  int64 // 被压缩的数据压缩前字节数
+	CompressedOut int64 // 被压缩的数据压缩后字节数
+}
+
+// Ratio 整体压缩比(压缩前/保存)
+func (this CompressionStatsSnapshot) Ratio() float64 {
+	if this.BytesOut == 0 {
+		return 0
+	}
+	return float64(this.BytesIn) / float64(this.BytesOut)
+}
+
+// CompressedRatio 只统计被压缩的数据的压缩比
+func (this CompressionStatsSnapshot) CompressedRatio() float64 {
+	if this.CompressedOut == 0 {
+		return 0
+	}
+	return float64(this.CompressedIn) / float64(this.CompressedOut)
+}
+
+func (this *CompressionStats) Snapshot() CompressionStatsSnapshot {
+	return CompressionStatsSnapshot{
+		Total:         atomic.LoadInt64(&this.total),
+		Compressed:    atomic.LoadInt64(&this.compressed),
+		BytesIn:       atomic.LoadInt64(&this.bytesIn),
+		BytesOut:      atomic.LoadInt64(&this.bytesOut),
+		CompressedIn:  atomic.LoadInt64(&this.compressedIn),
+		CompressedOut: atomic.LoadInt64(&this.compressedOut),
+	}
+}
+
+// GzipCompressor Level为0时使用gzip.DefaultCompression
+type GzipCompressor struct {
+	Level int
+}
+
+func (this GzipCompressor) Compress(in []byte) ([]byte, error) {
+	level := this.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	var buffer bytes.Buffer
+	writer, err := gzip.NewWriterLevel(&buffer, level)
+	if err != nil {
+		return nil, err
+	}
+	_, err = writer.Write(in)
+	if err != nil {
+		writer.Close()
+		return nil, err
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (this GzipCompressor) Decompress(in []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(in))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+type SnappyCompressor struct{}
+
+func (this SnappyCompressor) Compress(in []byte) ([]byte, error) {
+	return snappy.Encode(nil, in), nil
+}
+
+func (this SnappyCompressor) Decompress(in []byte) ([]byte, error) {
+	return snappy.Decode(nil, in)
+}
+
+func (this SnappyCompressor) DecompressBuffer(buf, in []byte) ([]byte, error) {
+	return snappy.Decode(buf[:cap(buf)], in)
+}
+
+// ZstdCompressor 零值使用默认压缩级别且不带字典，
+// 需要指定级别或字典时用NewZstdCompressor创建
+type ZstdCompressor struct {
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+var (
+	defaultZstdOnce       sync.Once
+	defaultZstdCompressor ZstdCompressor
+	defaultZstdErr        error
+)
+
+// NewZstdCompressor dict为nil时不使用字典，
+// 带字典压缩的数据只能用同一个字典解压，所以更换字典时要同时更换Encoding的id
+func NewZstdCompressor(level zstd.EncoderLevel, dict []byte) (ZstdCompressor, error) {
+	encoderOptions := []zstd.EOption{zstd.WithEncoderLevel(level)}
+	decoderOptions := []zstd.DOption{}
+	if len(dict) > 0 {
+		encoderOptions = append(encoderOptions, zstd.WithEncoderDict(dict))
+		decoderOptions = append(decoderOptions, zstd.WithDecoderDicts(dict))
+	}
+	encoder, err := zstd.NewWriter(nil, encoderOptions...)
+	if err != nil {
+		return ZstdCompressor{}, errors.Wrap(err, "create zstd encoder error")
+	}
+	decoder, err := zstd.NewReader(nil, decoderOptions...)
+	if err != nil {
+		return ZstdCompressor{}, errors.Wrap(err, "create zstd decoder error")
+	}
+	return ZstdCompressor{encoder: encoder, decoder: decoder}, nil
+}
+
+func (this ZstdCompressor) coder() (ZstdCompressor, error) {
+	if this.encoder != nil {
+		return this, nil
+	}
+	defaultZstdOnce.Do(func() {
+		defaultZstdCompressor, defaultZstdErr = NewZstdCompressor(zstd.SpeedDefault, nil)
+	})
+	return defaultZstdCompressor, defaultZstdErr
+}
+
+func (this ZstdCompressor) Compress(in []byte) ([]byte, error) {
+	coder, err := this.coder()
+	if err != nil {
+		return nil, err
+	}
+	return coder.encoder.EncodeAll(in, nil), nil
+}
+
+func (this ZstdCompressor) Decompress(in []byte) ([]byte, error) {
+	coder, err := this.coder()
+	if err != nil {
+		return nil, err
+	}
+	return coder.decoder.DecodeAll(in, nil)
+}
+
+func (this ZstdCompressor) DecompressBuffer(buf, in []byte) ([]byte, error) {
+	coder, err := this.coder()
+	if err != nil {
+		return nil, err
+	}
+	return coder.decoder.DecodeAll(in, buf[:0])
+}
+
+// LZ4Compressor 使用lz4 block格式，
+// layout: mode(1) | uncompressedSize(uvarint) | block，不可压缩的数据mode为0直接保存原始数据
+type LZ4Compressor struct{}
+
+const (
+	lz4ModeRaw byte = iota
+	lz4ModeBlock
+)
+
+func (this LZ4Compressor) Compress(in []byte) ([]byte, error) {
+	header := make([]byte, 1+binary.MaxVarintLen64)
+	n := 1 + binary.PutUvarint(header[1:], uint64(len(in)))
+	out := make([]byte, n+lz4.CompressBlockBound(len(in)))
+	size, err := lz4.CompressBlock(in, out[n:], nil)
+	if err != nil {
+		return nil, err
+	}
+	if size == 0 || size >= len(in) {
+		header[0] = lz4ModeRaw
+		return append(header[:n], in...), nil
+	}
+	header[0] = lz4ModeBlock
+	copy(out, header[:n])
+	return out[:n+size], nil
+}
+
+// lz4MaxRatio lz4 block每个输入字节最多解压出255个字节
+const lz4MaxRatio = 255
+
+func (this LZ4Compressor) Decompress(in []byte) ([]byte, error) {
+	return this.DecompressBuffer(nil, in)
+}
+
+func (this LZ4Compressor) DecompressBuffer(buf, in []byte) ([]byte, error) {
+	if len(in) < 2 {
+		return nil, errors.New("lz4 data truncated")
+	}
+	mode := in[0]
+	size, n := binary.Uvarint(in[1:])
+	if n <= 0 {
+		return nil, errors.New("lz4 size header invalid")
+	}
+	in = in[1+n:]
+	switch mode {
+	case lz4ModeRaw:
+		if uint64(len(in)) != size {
+			return nil, errors.New("lz4 raw data size mismatch")
+		}
+		return append(buf[:0], in...), nil
+	case lz4ModeBlock:
+		// size来自数据本身，先按lz4最大压缩率检查，避免损坏的数据分配过大的空间
+		if size > uint64(len(in))*lz4MaxRatio {
+			return nil, errors.New("lz4 size header invalid")
+		}
+		if uint64(cap(buf)) < size {
+			buf = make([]byte, size)
+		}
+		out := buf[:size]
+		m, err := lz4.UncompressBlock(in, out)
+		if err != nil {
+			return nil, err
+		}
+		if uint64(m) != size {
+			return nil, errors.New("lz4 uncompressed size mismatch")
+		}
+		return out, nil
+	default:
+		return nil, errors.Newf("unknown lz4 mode %d", mode)
+	}
+}
+
+// TrainZstdDictionary 用样本训练zstd字典，样本应该是内层Encoding序列化后未压缩的数据，
+// 可以用RedisStorage.SampleValues从线上数据采样
+func TrainZstdDictionary(samples [][]byte, dictSize int) ([]byte, error) {
+	if len(samples) == 0 {
+		return nil, errors.New("no samples to train zstd dictionary")
+	}
+	dictionary, err := dict.BuildZstdDict(samples, dict.Options{
+		MaxDictSize: dictSize,
+		HashBytes:   6,
+		ZstdLevel:   zstd.SpeedDefault,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "build zstd dictionary error")
+	}
+	return dictionary, nil
+}
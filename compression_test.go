@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+type compressionSample struct {
+	ID       int64    `json:"id"`
+	Name     string   `json:"name"`
+	Email    string   `json:"email"`
+	Tags     []string `json:"tags"`
+	Verified bool     `json:"verified"`
+}
+
+func compressionSamples(count int) [][]byte {
+	samples := make([][]byte, count)
+	for i := range samples {
+		samples[i], _ = JsonEncoding{}.Marshal(compressionSample{
+			ID:       int64(i),
+			Name:     fmt.Sprintf("user name %d", i),
+			Email:    fmt.Sprintf("user%d@example.com", i),
+			Tags:     []string{"golang", "redis", fmt.Sprintf("tag%d", i%7)},
+			Verified: i%2 == 0,
+		})
+	}
+	return samples
+}
+
+func TestCompressorRoundTrip(t *testing.T) {
+	zstdCompressor, err := NewZstdCompressor(zstd.SpeedBestCompression, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputs := [][]byte{
+		{},
+		[]byte("x"),
+		bytes.Repeat([]byte("compressible "), 100),
+		make([]byte, 1<<20), // 压缩率接近lz4的上限
+		compressionSamples(1)[0],
+	}
+	for name, compressor := range map[string]Compressor{
+		"gzip":       GzipCompressor{},
+		"snappy":     SnappyCompressor{},
+		"zstd":       ZstdCompressor{},
+		"zstd_level": zstdCompressor,
+		"lz4":        LZ4Compressor{},
+	} {
+		for _, in := range inputs {
+			compressed, err := compressor.Compress(in)
+			if err != nil {
+				t.Fatalf("%s compress error %v", name, err)
+			}
+			out, err := compressor.Decompress(compressed)
+			if err != nil || !bytes.Equal(out, in) {
+				t.Errorf("%s round trip failed, len=%d out=%d err=%v", name, len(in), len(out), err)
+			}
+			if decompressor, ok := compressor.(BufferDecompressor); ok {
+				out, err = decompressor.DecompressBuffer(make([]byte, 0, 4), compressed)
+				if err != nil || !bytes.Equal(out, in) {
+					t.Errorf("%s buffer round trip failed, len=%d out=%d err=%v", name, len(in), len(out), err)
+				}
+			}
+		}
+	}
+}
+
+func TestLZ4CompressorCorrupt(t *testing.T) {
+	compressed, _ := LZ4Compressor{}.Compress(bytes.Repeat([]byte("abc"), 100))
+	for _, data := range [][]byte{
+		nil,
+		{lz4ModeBlock},
+		{9, 1, 0},
+		compressed[:len(compressed)/2],
+		{lz4ModeRaw, 10, 'a'},
+		{lz4ModeBlock, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01, 0},
+		{lz4ModeBlock, 0x80, 0x80, 0x80, 0x80, 0x04, 0x1f, 'a'},
+	} {
+		if _, err := (LZ4Compressor{}).Decompress(data); err == nil {
+			t.Errorf("corrupt lz4 data %v should fail", data)
+		}
+	}
+}
+
+func TestZstdDictionary(t *testing.T) {
+	samples := compressionSamples(500)
+	dictionary, err := TrainZstdDictionary(samples, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressor, err := NewZstdCompressor(zstd.SpeedDefault, dictionary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoding := CompressEncoding{JsonEncoding{}, compressor}
+	value := compressionSample{ID: 1000, Name: "user name 1000", Email: "user1000@example.com", Tags: []string{"golang"}}
+	data, err := encoding.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, _ := CompressEncoding{JsonEncoding{}, ZstdCompressor{}}.Marshal(value)
+	if len(data) >= len(plain) {
+		t.Errorf("dictionary should compress small values better, %d >= %d", len(data), len(plain))
+	}
+	var result compressionSample
+	if err := encoding.Unmarshal(data, &result); err != nil || result.Email != value.Email {
+		t.Errorf("unmarshal with the same dictionary failed, value=%+v err=%v", result, err)
+	}
+
+	// 用别的字典或者不带字典解压要返回error
+	other, err := TrainZstdDictionary(compressionSamples(300)[100:], 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCompressor, err := NewZstdCompressor(zstd.SpeedDefault, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, wrong := range map[string]Compressor{"other dictionary": otherCompressor, "no dictionary": ZstdCompressor{}} {
+		if err := (CompressEncoding{JsonEncoding{}, wrong}).Unmarshal(data, &result); err == nil {
+			t.Errorf("decompress with %s should fail", name)
+		}
+	}
+
+	if _, err := TrainZstdDictionary(nil, 4096); err == nil {
+		t.Errorf("train without samples should fail")
+	}
+}
+
+func TestRedisStorageSampleValues(t *testing.T) {
+	ctx := context.Background()
+	_, client := newMiniRedisClient(t)
+	storage := NewRedisStorage(client, "sample", 0, JsonEncoding{}, nil, false)
+	storage.WriteEnvelope = true
+	storage.ChunkSize = 64
+	values := map[Key]interface{}{}
+	for i := 0; i < 20; i++ {
+		values[Int(i)] = compressionSample{ID: int64(i), Name: fmt.Sprintf("user name %d", i)}
+	}
+	if err := storage.MultiSet(ctx, values); err != nil {
+		t.Fatal(err)
+	}
+	other := NewRedisStorage(client, "other", 0, JsonEncoding{}, nil, false)
+	other.Set(ctx, Int(1), "not a sample")
+
+	samples, err := storage.SampleValues(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 10 {
+		t.Fatalf("should sample 10 values, got %d", len(samples))
+	}
+	for _, sample := range samples {
+		// payload去掉了envelope，chunk已经拼接
+		var value compressionSample
+		if err := (JsonEncoding{}).Unmarshal(sample, &value); err != nil || value.Name == "" {
+			t.Errorf("sample should be the json payload, got %q err=%v", sample, err)
+		}
+	}
+
+	if samples, err = storage.SampleValues(ctx, 100); err != nil || len(samples) != 20 {
+		t.Errorf("should sample all 20 values, got %d err=%v", len(samples), err)
+	}
+}
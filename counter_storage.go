@@ -1,21 +1,20 @@
 package storage
 
 import (
+	"context"
 	"time"
 
-	"github.com/dropbox/godropbox/errors"
 	log "github.com/golang/glog"
-	"github.com/1024casts/go-common/context"
 )
 
 type CounterStorage interface {
-	Get(ctx *context.Context, key Key) (value int64, err error)
-	Set(ctx *context.Context, key Key, value int64) error
-	Incr(ctx *context.Context, key Key, step int64) (newValue int64, err error)
-	Decr(ctx *context.Context, key Key, step int64) (newValue int64, err error)
-	Delete(ctx *context.Context, key ...Key) error
-	MultiGet(ctx *context.Context, keys []Key, values map[Key]int64) (err error)
-	MultiSet(ctx *context.Context, m map[Key]int64) error
+	Get(ctx context.Context, key Key) (value int64, err error)
+	Set(ctx context.Context, key Key, value int64) error
+	Incr(ctx context.Context, key Key, step int64) (newValue int64, err error)
+	Decr(ctx context.Context, key Key, step int64) (newValue int64, err error)
+	Delete(ctx context.Context, key ...Key) error
+	MultiGet(ctx context.Context, keys []Key, values map[Key]int64) (err error)
+	MultiSet(ctx context.Context, m map[Key]int64) error
 }
 
 type CounterRedisStorage struct {
@@ -24,59 +23,90 @@ type CounterRedisStorage struct {
 	BenchMarkKeyPrefix string
 	DefaultExpireTime  time.Duration
 	encoding           Encoding
+	// SlidingExpiration 为true时Get/MultiGet命中会把key的过期时间刷新为DefaultExpireTime
+	SlidingExpiration bool
+	// Batch 控制MultiGet/MultiSet/Delete拆分批次和并发执行，见batch.go
+	Batch BatchOptions
 }
 
 func NewCounterRedisStorage(client RedisClient, keyPrefix string, BenchMarkKeyPrefix string, defaultExpireTime time.Duration) CounterStorage {
-	return CounterRedisStorage{client, keyPrefix, BenchMarkKeyPrefix, defaultExpireTime, Int64Encoding{}}
+	return CounterRedisStorage{
+		client:             client,
+		KeyPrefix:          keyPrefix,
+		BenchMarkKeyPrefix: BenchMarkKeyPrefix,
+		DefaultExpireTime:  defaultExpireTime,
+		encoding:           Int64Encoding{},
+	}
+}
+
+func (this CounterRedisStorage) isSliding() bool {
+	return this.SlidingExpiration && this.DefaultExpireTime > 0
+}
+
+func (this CounterRedisStorage) TTL(ctx context.Context, key Key) (time.Duration, error) {
+	return redisTTL(ctx, this.client, this.KeyPrefix, key)
+}
+
+func (this CounterRedisStorage) Touch(ctx context.Context, key Key, ttl time.Duration) error {
+	return redisTouch(ctx, this.client, this.KeyPrefix, key, ttl)
+}
+
+func (this CounterRedisStorage) Exists(ctx context.Context, keys ...Key) (map[Key]bool, error) {
+	return redisExists(ctx, this.client, this.KeyPrefix, keys)
 }
 
-func (this CounterRedisStorage) Incr(ctx *context.Context, key Key, step int64) (newValue int64, err error) {
+func (this CounterRedisStorage) Incr(ctx context.Context, key Key, step int64) (newValue int64, err error) {
 	var cacheKey string
 	cacheKey, err = BuildCacheKey(this.KeyPrefix, key)
 	if err != nil {
-		return 0, errors.Wrap(err, "build cache key error")
+		return 0, wrapError(err, "build cache key error")
 
 	}
 
-	result, errcache := this.client.Incr(cacheKey, step)
+	result, errcache := this.client.Incr(ctx, cacheKey, step)
 	if this.DefaultExpireTime > 0 {
-		this.client.Expire(cacheKey, this.DefaultExpireTime)
+		this.client.Expire(ctx, cacheKey, this.DefaultExpireTime)
 	}
 
 	return int64(result), errcache
 }
 
-func (this CounterRedisStorage) Decr(ctx *context.Context, key Key, step int64) (newValue int64, err error) {
+func (this CounterRedisStorage) Decr(ctx context.Context, key Key, step int64) (newValue int64, err error) {
 	var cacheKey string
 	cacheKey, err = BuildCacheKey(this.KeyPrefix, key)
 	if err != nil {
-		return 0, errors.Wrap(err, "build cache key error")
+		return 0, wrapError(err, "build cache key error")
 
 	}
-	result, errcache := this.client.Decr(cacheKey, step)
+	result, errcache := this.client.Decr(ctx, cacheKey, step)
 	if result < 0 {
 		return 0, err
 	}
 	if this.DefaultExpireTime > 0 {
-		this.client.Expire(cacheKey, this.DefaultExpireTime)
+		this.client.Expire(ctx, cacheKey, this.DefaultExpireTime)
 	}
 	return int64(result), errcache
 }
 
-func (this CounterRedisStorage) Get(ctx *context.Context, key Key) (value int64, err error) {
+func (this CounterRedisStorage) Get(ctx context.Context, key Key) (value int64, err error) {
 	var cacheKey string
 	cacheKey, err = BuildCacheKey(this.KeyPrefix, key)
 	if err != nil {
-		return 0, errors.Wrap(err, "build cache key error")
+		return 0, wrapError(err, "build cache key error")
 
 	}
 
-	data, err := this.client.Get(cacheKey)
+	var data []byte
+	if this.isSliding() {
+		data, err = this.client.GetExpire(ctx, cacheKey, this.DefaultExpireTime)
+	} else {
+		data, err = this.client.Get(ctx, cacheKey)
+	}
 	if err != nil {
-		if err.Error() == "redis: nil" {
+		if isRedisNil(err) {
 			// log.Infoln(err)
 		} else {
-			return 0, errors.Wrapf(err, "get from redis error key is %s", cacheKey)
+			return 0, wrapErrorf(err, "get from redis error key is %s", cacheKey)
 		}
 	}
 	if data == nil || len(data) == 0 {
@@ -84,12 +114,12 @@ func (this CounterRedisStorage) Get(ctx *context.Context, key Key) (value int64,
 	}
 	err = this.encoding.Unmarshal(data, &value)
 	if err != nil {
-		return 0, errors.Wrapf(err, "unmarshal  error , is %s ", string(data))
+		return 0, wrapErrorf(markError(ErrDecode, err), "unmarshal  error , is %s ", string(data))
 	}
 	return value, nil
 }
 
-func (this CounterRedisStorage) Set(ctx *context.Context, key Key, value int64) error {
+func (this CounterRedisStorage) Set(ctx context.Context, key Key, value int64) error {
 
 	var (
 		cacheKey string
@@ -97,58 +127,73 @@ func (this CounterRedisStorage) Set(ctx *context.Context, key Key, value int64)
 	)
 	cacheKey, err = BuildCacheKey(this.KeyPrefix, key)
 	if err != nil {
-		return errors.Wrap(err, "build cache key error")
+		return wrapError(err, "build cache key error")
 	}
 
 	buf, err := this.encoding.Marshal(value)
 	if err != nil {
-		return errors.Wrapf(err, "marshal  error,data is %+v", value)
+		return wrapErrorf(err, "marshal  error,data is %+v", value)
 	}
 
-	if err = this.client.Set(cacheKey, buf, this.DefaultExpireTime); err != nil {
-		return errors.Wrap(err, "redis set error")
+	if err = this.client.Set(ctx, cacheKey, buf, this.DefaultExpireTime); err != nil {
+		return wrapError(err, "redis set error")
 	}
 	return nil
 }
 
-func (this CounterRedisStorage) Delete(ctx *context.Context, keyList ...Key) error {
+func (this CounterRedisStorage) Delete(ctx context.Context, keyList ...Key) error {
 	if len(keyList) == 0 {
 		return nil
 	}
-	var cacheKeyList []string = make([]string, len(keyList))
-	var err error
-	for storagekeyIdx, key := range keyList {
-		cacheKeyList[storagekeyIdx], err = BuildCacheKey(this.KeyPrefix, key)
+	multiErr := &MultiError{}
+	cacheKeyList := make([]string, 0, len(keyList))
+	keys := make([]Key, 0, len(keyList))
+	for _, key := range keyList {
+		cacheKey, err := BuildCacheKey(this.KeyPrefix, key)
 		if err != nil {
-			return errors.Wrapf(err, "build cache key error ,key is %+v", key)
+			multiErr.Add(key, StageBuildKey, err)
+			if this.Batch.FailFast {
+				return multiErr
+			}
+			continue
 		}
+		cacheKeyList = append(cacheKeyList, cacheKey)
+		keys = append(keys, key)
 	}
-	_, err = this.client.Del(cacheKeyList...)
-	if err != nil {
-		return errors.Wrapf(err, "redis delete error,keys is %+v", keyList)
-	}
-	return nil
+	_, keyErrs := this.Batch.del(ctx, this.client, cacheKeyList)
+	multiErr.addAll(keys, StageRedis, keyErrs)
+	return multiErr.ErrorOrNil()
 }
 
-func (this CounterRedisStorage) MultiGet(ctx *context.Context, keys []Key, values map[Key]int64) (err error) {
+func (this CounterRedisStorage) MultiGet(ctx context.Context, keys []Key, values map[Key]int64) (err error) {
 	if len(keys) == 0 {
 		return nil
 	}
 
-	cacheKeys := make([]string, len(keys))
-	for index, key := range keys {
-		cacheKey := ""
-		cacheKey, err = BuildCacheKey(this.KeyPrefix, key)
+	multiErr := &MultiError{}
+	cacheKeys := make([]string, 0, len(keys))
+	fetchKeys := make([]Key, 0, len(keys))
+	for _, key := range keys {
+		cacheKey, err := BuildCacheKey(this.KeyPrefix, key)
 		if err != nil {
-			return errors.Wrapf(err, "build cache key error ,key is %+v", key)
+			multiErr.Add(key, StageBuildKey, err)
+			if this.Batch.FailFast {
+				return multiErr
+			}
+			continue
 		}
-		cacheKeys[index] = cacheKey
+		cacheKeys = append(cacheKeys, cacheKey)
+		fetchKeys = append(fetchKeys, key)
 	}
 
-	val, err := this.client.MGet(cacheKeys...)
-	if err != nil {
-		return errors.Wrap(err, "redis get error")
+	get := this.client.MGet
+	if this.isSliding() {
+		get = func(ctx context.Context, keys ...string) ([]interface{}, error) {
+			return this.client.MGetExpire(ctx, this.DefaultExpireTime, keys...)
+		}
 	}
+	val, keyErrs := this.Batch.mget(ctx, this.client, cacheKeys, get)
+	multiErr.addAll(fetchKeys, StageRedis, keyErrs)
 
 	for i, value := range val {
 		if value == nil {
@@ -158,37 +203,49 @@ func (this CounterRedisStorage) MultiGet(ctx *context.Context, keys []Key, value
 		err := this.encoding.Unmarshal([]byte(value.(string)), &object)
 		if err != nil {
 			log.Warningf("cant't unmarshal json ,json string is %+v", value)
+			multiErr.Add(fetchKeys[i], StageDecode, err)
+			if this.Batch.FailFast {
+				return multiErr
+			}
 			continue
 		}
-		values[keys[i]] = object
+		values[fetchKeys[i]] = object
 	}
-	return nil
+	return multiErr.ErrorOrNil()
 }
 
-func (this CounterRedisStorage) MultiSet(ctx *context.Context, valueMap map[Key]int64) error {
+func (this CounterRedisStorage) MultiSet(ctx context.Context, valueMap map[Key]int64) error {
 	if len(valueMap) == 0 {
 		return nil
 	}
+	multiErr := &MultiError{}
 	values := make([]interface{}, 0, 2*len(valueMap))
+	pairKeys := make([]Key, 0, len(valueMap))
 	for key, value := range valueMap {
 		buf, err := this.encoding.Marshal(value)
 		if err != nil {
 			log.Warningf("cant't unmarshal json ,json string is %+v", value)
+			multiErr.Add(key, StageEncode, err)
+			if this.Batch.FailFast {
+				return multiErr
+			}
 			continue
 		}
 		cacheKey := ""
 		cacheKey, err = BuildCacheKey(this.KeyPrefix, key)
 		if err != nil {
 			log.Warningf("build cache key error ,key is %+v", key)
+			multiErr.Add(key, StageBuildKey, err)
+			if this.Batch.FailFast {
+				return multiErr
+			}
 			continue
 		}
 		values = append(values, ([]byte(cacheKey)))
 		values = append(values, (buf))
+		pairKeys = append(pairKeys, key)
 	}
 
-	err := this.client.MSet(this.DefaultExpireTime, values...)
-	if err != nil {
-		return errors.Wrap(err, "redis set error")
-	}
-	return nil
+	multiErr.addAll(pairKeys, StageRedis, this.Batch.mset(ctx, this.client, this.DefaultExpireTime, values))
+	return multiErr.ErrorOrNil()
 }
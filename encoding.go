@@ -8,8 +8,6 @@ import (
 	"encoding/json"
 	"io/ioutil"
 
-	"strconv"
-
 	"github.com/golang/snappy"
 	"github.com/vmihailenco/msgpack"
 )
@@ -53,9 +51,51 @@ func Unmarshal(e Encoding, data []byte, v interface{}) (err error) {
 	return
 }
 
+// KeyedEncoding 由需要知道cache key的Encoding实现(比如把key作为加密的associated data)，
+// RedisStorage读写时优先使用MarshalKey/UnmarshalKey
+type KeyedEncoding interface {
+	Encoding
+	MarshalKey(cacheKey string, v interface{}) ([]byte, error)
+	UnmarshalKey(cacheKey string, data []byte, value interface{}) error
+}
+
+func MarshalKey(e Encoding, cacheKey string, v interface{}) ([]byte, error) {
+	if keyed, ok := e.(KeyedEncoding); ok {
+		return keyed.MarshalKey(cacheKey, v)
+	}
+	return Marshal(e, v)
+}
+
+func UnmarshalKey(e Encoding, cacheKey string, data []byte, v interface{}) error {
+	if keyed, ok := e.(KeyedEncoding); ok {
+		return keyed.UnmarshalKey(cacheKey, data, v)
+	}
+	return Unmarshal(e, data, v)
+}
+
+// keyedEncoding 把cache key绑定到Encoding上，用于只接受Encoding的地方(比如Upcaster)
+type keyedEncoding struct {
+	e        Encoding
+	cacheKey string
+}
+
+func (this keyedEncoding) Marshal(v interface{}) ([]byte, error) {
+	return MarshalKey(this.e, this.cacheKey, v)
+}
+
+func (this keyedEncoding) Unmarshal(data []byte, value interface{}) error {
+	return UnmarshalKey(this.e, this.cacheKey, data, value)
+}
+
+// JsonEncoding encoding/json按字段定义顺序输出struct，map按key排序，
+// 相同的对象总是得到相同的数据
 type JsonEncoding struct {
 }
 
+func (this JsonEncoding) IsDeterministic() bool {
+	return true
+}
+
 func (this JsonEncoding) Marshal(v interface{}) ([]byte, error) {
 	buf, err := json.Marshal(v)
 	return buf, err
@@ -69,6 +109,11 @@ func (this JsonEncoding) Unmarshal(data []byte, value interface{}) error {
 	return nil
 }
 
+// UnmarshalString encoding/json不会修改和保留输入，可以直接使用string的内存
+func (this JsonEncoding) UnmarshalString(data string, value interface{}) error {
+	return json.Unmarshal(stringBytes(data), value)
+}
+
 type GobEncoding struct {
 }
 
@@ -152,64 +197,36 @@ func GzipDecode(in []byte) ([]byte, error) {
 	return ioutil.ReadAll(reader)
 }
 
+// Int64Encoding 和IntEncoding使用相同的十进制文本格式，支持所有int/uint类型的值和指针，
+// 见ScalarEncoding
 type Int64Encoding struct {
 }
 
 func (this Int64Encoding) Marshal(v interface{}) (data []byte, err error) {
-	switch v.(type) {
-	case int64:
-		data = strconv.AppendInt(data, v.(int64), 10)
-	case *int64:
-		data = strconv.AppendInt(data, *(v.(*int64)), 10)
-	case int:
-		data = strconv.AppendInt(data, int64(v.(int)), 10)
-	case *int:
-		data = strconv.AppendInt(data, int64(*(v.(*int))), 10)
-	default:
-	}
-
-	return data, nil
+	return marshalScalar("Int64Encoding", scalarInteger, v)
 }
 
 func (this Int64Encoding) Unmarshal(data []byte, value interface{}) error {
-	i, err := strconv.ParseInt(string(data), 10, 0)
-	if err != nil {
-		return err
-	}
-	result := value.(*int64)
-	*result = int64(i)
+	return unmarshalScalar("Int64Encoding", scalarInteger, string(data), value)
+}
 
-	return nil
+func (this Int64Encoding) UnmarshalString(data string, value interface{}) error {
+	return unmarshalScalar("Int64Encoding", scalarInteger, data, value)
 }
 
 type IntEncoding struct {
 }
 
 func (this IntEncoding) Marshal(v interface{}) (data []byte, err error) {
-	switch v.(type) {
-	case int64:
-		data = strconv.AppendInt(data, v.(int64), 10)
-	case *int64:
-		data = strconv.AppendInt(data, *(v.(*int64)), 10)
-	case int:
-		data = strconv.AppendInt(data, int64(v.(int)), 10)
-	case *int:
-		data = strconv.AppendInt(data, int64(*(v.(*int))), 10)
-	default:
-	}
-
-	return data, nil
+	return marshalScalar("IntEncoding", scalarInteger, v)
 }
 
 func (this IntEncoding) Unmarshal(data []byte, value interface{}) error {
-	i, err := strconv.Atoi(string(data))
-	if err != nil {
-		return err
-	}
-	result := value.(*int)
-	*result = i
+	return unmarshalScalar("IntEncoding", scalarInteger, string(data), value)
+}
 
-	return nil
+func (this IntEncoding) UnmarshalString(data string, value interface{}) error {
+	return unmarshalScalar("IntEncoding", scalarInteger, data, value)
 }
 
 // add string encoding
@@ -217,21 +234,15 @@ type StringEncoding struct {
 }
 
 func (s StringEncoding) Marshal(v interface{}) (data []byte, err error) {
-	switch v.(type) {
-	case string:
-		data = []byte(v.(string))
-	case *string:
-		data = []byte(*(v.(*string)))
-	default:
-	}
-
-	return data, nil
+	return marshalScalar("StringEncoding", scalarString|scalarBytes, v)
 }
 
 func (s StringEncoding) Unmarshal(data []byte, value interface{}) error {
-	result := value.(*string)
-	*result = string(data)
-	return nil
+	return unmarshalScalar("StringEncoding", scalarString|scalarBytes, string(data), value)
+}
+
+func (s StringEncoding) UnmarshalString(data string, value interface{}) error {
+	return unmarshalScalar("StringEncoding", scalarString|scalarBytes, data, value)
 }
 
 // JSONSnappyEncoding json格式和snappy压缩
@@ -257,10 +268,24 @@ func (s JSONSnappyEncoding) Unmarshal(data []byte, value interface{}) error {
 	return json.Unmarshal(b, value)
 }
 
+// MsgPackEncoding Deterministic为true时所有map按编码后的key排序输出
 type MsgPackEncoding struct {
+	Deterministic bool
+}
+
+func (this MsgPackEncoding) IsDeterministic() bool {
+	return this.Deterministic
 }
 
 func (this MsgPackEncoding) Marshal(v interface{}) ([]byte, error) {
+	if this.Deterministic {
+		var buffer bytes.Buffer
+		err := msgpack.NewEncoder(&buffer).SortMapKeys(true).Encode(v)
+		if err != nil {
+			return nil, err
+		}
+		return canonicalMsgpack(buffer.Bytes())
+	}
 	buf, err := msgpack.Marshal(v)
 	return buf, err
 }
@@ -272,3 +297,7 @@ func (this MsgPackEncoding) Unmarshal(data []byte, value interface{}) error {
 	}
 	return nil
 }
+
+func (this MsgPackEncoding) UnmarshalString(data string, value interface{}) error {
+	return msgpack.Unmarshal(stringBytes(data), value)
+}
@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"github.com/fxamacker/cbor/v2"
+)
+
+// CBOREncoding Deterministic为true时使用RFC 8949 core deterministic encoding，
+// map按key排序且整数/浮点数使用最短编码，相同的对象总是得到相同的数据
+type CBOREncoding struct {
+	Deterministic bool
+}
+
+var (
+	cborEncMode              cbor.EncMode
+	cborDeterministicEncMode cbor.EncMode
+)
+
+func init() {
+	var err error
+	cborEncMode, err = cbor.EncOptions{}.EncMode()
+	if err != nil {
+		panic(err)
+	}
+	cborDeterministicEncMode, err = cbor.CoreDetEncOptions().EncMode()
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (this CBOREncoding) IsDeterministic() bool {
+	return this.Deterministic
+}
+
+func (this CBOREncoding) Marshal(v interface{}) ([]byte, error) {
+	if this.Deterministic {
+		return cborDeterministicEncMode.Marshal(v)
+	}
+	return cborEncMode.Marshal(v)
+}
+
+func (this CBOREncoding) Unmarshal(data []byte, value interface{}) error {
+	return cbor.Unmarshal(data, value)
+}
+
+func (this CBOREncoding) UnmarshalString(data string, value interface{}) error {
+	return cbor.Unmarshal(stringBytes(data), value)
+}
+
+// DeterministicEncoding 由可以保证相同对象得到相同数据的Encoding实现，
+// 基于value做内容hash去重或者compare-and-swap时需要使用这类Encoding
+type DeterministicEncoding interface {
+	IsDeterministic() bool
+}
+
+func IsDeterministicEncoding(e Encoding) bool {
+	d, ok := e.(DeterministicEncoding)
+	return ok && d.IsDeterministic()
+}
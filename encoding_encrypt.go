@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+	"sync"
+
+	"github.com/dropbox/godropbox/errors"
+)
+
+// Keyring 保存EncryptedEncoding使用的AES key，
+// 用active key加密，用header中key id对应的key解密，轮换key时先AddKey再SetActive，
+// 旧key要保留到用它加密的数据全部过期
+type Keyring struct {
+	lock   sync.RWMutex
+	keys   map[byte]cipher.AEAD
+	active byte
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring{keys: make(map[byte]cipher.AEAD)}
+}
+
+// AddKey key的长度必须是16, 24或32字节(AES-128, AES-192, AES-256)，第一个加入的key默认为active key
+func (this *Keyring) AddKey(id byte, key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return errors.Wrapf(err, "create aes cipher for key %d error", id)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return errors.Wrapf(err, "create gcm for key %d error", id)
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if len(this.keys) == 0 {
+		this.active = id
+	}
+	this.keys[id] = aead
+	return nil
+}
+
+func (this *Keyring) SetActive(id byte) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if _, ok := this.keys[id]; !ok {
+		return errors.Newf("key %d is not in keyring", id)
+	}
+	this.active = id
+	return nil
+}
+
+func (this *Keyring) activeKey() (byte, cipher.AEAD, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	aead, ok := this.keys[this.active]
+	if !ok {
+		return 0, nil, errors.New("keyring has no active key")
+	}
+	return this.active, aead, nil
+}
+
+func (this *Keyring) key(id byte) (cipher.AEAD, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	aead, ok := this.keys[id]
+	if !ok {
+		return nil, errors.Newf("key %d is not in keyring", id)
+	}
+	return aead, nil
+}
+
+// EncryptedEncoding 用AES-GCM加密Encoding序列化后的数据，
+// layout: keyID(1) | nonce(12) | ciphertext+tag。
+// 通过RedisStorage使用时cache key会作为associated data，value被复制到其他key下无法解密
+type EncryptedEncoding struct {
+	Encoding Encoding
+	Keyring  *Keyring
+}
+
+func (this EncryptedEncoding) Marshal(v interface{}) ([]byte, error) {
+	return this.MarshalKey("", v)
+}
+
+func (this EncryptedEncoding) Unmarshal(data []byte, value interface{}) error {
+	return this.UnmarshalKey("", data, value)
+}
+
+func (this EncryptedEncoding) MarshalKey(cacheKey string, v interface{}) ([]byte, error) {
+	plaintext, err := MarshalKey(this.Encoding, cacheKey, v)
+	if err != nil {
+		return nil, err
+	}
+	id, aead, err := this.Keyring.activeKey()
+	if err != nil {
+		return nil, err
+	}
+	headerSize := 1 + aead.NonceSize()
+	data := make([]byte, headerSize, headerSize+len(plaintext)+aead.Overhead())
+	data[0] = id
+	if _, err = io.ReadFull(rand.Reader, data[1:headerSize]); err != nil {
+		return nil, errors.Wrap(err, "generate nonce error")
+	}
+	return aead.Seal(data, data[1:headerSize], plaintext, []byte(cacheKey)), nil
+}
+
+func (this EncryptedEncoding) UnmarshalKey(cacheKey string, data []byte, value interface{}) error {
+	if len(data) < 1 {
+		return errors.New("encrypted data is empty")
+	}
+	aead, err := this.Keyring.key(data[0])
+	if err != nil {
+		return err
+	}
+	headerSize := 1 + aead.NonceSize()
+	if len(data) < headerSize+aead.Overhead() {
+		return errors.New("encrypted data truncated")
+	}
+	plaintext, err := aead.Open(nil, data[1:headerSize], data[headerSize:], []byte(cacheKey))
+	if err != nil {
+		return errors.Wrapf(err, "decrypt value with key %d error", data[0])
+	}
+	return UnmarshalKey(this.Encoding, cacheKey, plaintext, value)
+}
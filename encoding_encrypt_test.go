@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncryptedEncodingKeyRotation(t *testing.T) {
+	keyring := NewKeyring()
+	if err := keyring.AddKey(1, bytes.Repeat([]byte{1}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	encoding := EncryptedEncoding{Encoding: JsonEncoding{}, Keyring: keyring}
+
+	data, err := encoding.MarshalKey("user_1", map[string]string{"phone": "123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("123")) {
+		t.Error("value should be encrypted")
+	}
+
+	if err = keyring.AddKey(2, bytes.Repeat([]byte{2}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	if err = keyring.SetActive(2); err != nil {
+		t.Fatal(err)
+	}
+	var value map[string]string
+	if err = encoding.UnmarshalKey("user_1", data, &value); err != nil || value["phone"] != "123" {
+		t.Errorf("decrypt with rotated keyring failed, value=%v err=%v", value, err)
+	}
+	if err = encoding.UnmarshalKey("user_2", data, &value); err == nil {
+		t.Error("value should not be readable under another key")
+	}
+
+	data, err = encoding.MarshalKey("user_1", "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[0] != 2 {
+		t.Errorf("value should be encrypted with active key 2, got %d", data[0])
+	}
+}
@@ -0,0 +1,244 @@
+package storage
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+	"reflect"
+
+	"github.com/dropbox/godropbox/errors"
+)
+
+// IntListEncoding 用于[]int, []int32, []int64的紧凑编码，
+// 每个元素保存和前一个元素的差值，有序(非递减)列表差值用uvarint，否则用zigzag varint。
+// BitPacking为true时差值按最大值需要的bit数紧密排列，适合差值比较均匀的列表(比如连续id)。
+//
+// layout: flags(1) | count(uvarint) | first(zigzag varint) | deltas
+// deltas: varint编码时逐个排列；bit-packing时为 width(1) | packed bits(little endian)
+type IntListEncoding struct {
+	BitPacking bool
+}
+
+const (
+	intListFlagSorted byte = 1 << iota
+	intListFlagBitPacked
+)
+
+// maxIntListCount 解码时元素个数的上限，避免损坏的数据分配过大的空间
+const maxIntListCount = 1 << 24
+
+func zigzagEncode(v int64) uint64 {
+	return uint64(v<<1) ^ uint64(v>>63)
+}
+
+func zigzagDecode(v uint64) int64 {
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func intListValues(v interface{}) ([]int64, error) {
+	switch list := v.(type) {
+	case []int64:
+		return list, nil
+	case *[]int64:
+		return *list, nil
+	case []int32:
+		values := make([]int64, len(list))
+		for i, value := range list {
+			values[i] = int64(value)
+		}
+		return values, nil
+	case *[]int32:
+		return intListValues(*list)
+	case []int:
+		values := make([]int64, len(list))
+		for i, value := range list {
+			values[i] = int64(value)
+		}
+		return values, nil
+	case *[]int:
+		return intListValues(*list)
+	default:
+		return nil, errors.Newf("int list encoding unsupported type %v", reflect.TypeOf(v))
+	}
+}
+
+func (this IntListEncoding) Marshal(v interface{}) ([]byte, error) {
+	values, err := intListValues(v)
+	if err != nil {
+		return nil, err
+	}
+	var flags byte
+	if this.BitPacking {
+		flags |= intListFlagBitPacked
+	}
+	sorted := true
+	for i := 1; i < len(values); i++ {
+		if values[i] < values[i-1] {
+			sorted = false
+			break
+		}
+	}
+	if sorted {
+		flags |= intListFlagSorted
+	}
+
+	data := make([]byte, 1, 2*binary.MaxVarintLen64+2*len(values))
+	data[0] = flags
+	data = binary.AppendUvarint(data, uint64(len(values)))
+	if len(values) == 0 {
+		return data, nil
+	}
+	data = binary.AppendUvarint(data, zigzagEncode(values[0]))
+
+	deltas := make([]uint64, len(values)-1)
+	var max uint64
+	for i := 1; i < len(values); i++ {
+		delta := uint64(values[i]) - uint64(values[i-1])
+		if !sorted {
+			delta = zigzagEncode(int64(delta))
+		}
+		deltas[i-1] = delta
+		if delta > max {
+			max = delta
+		}
+	}
+
+	if !this.BitPacking {
+		for _, delta := range deltas {
+			data = binary.AppendUvarint(data, delta)
+		}
+		return data, nil
+	}
+
+	// width至少为1，解码时可以按数据长度检查count
+	width := bits.Len64(max)
+	if width == 0 {
+		width = 1
+	}
+	data = append(data, byte(width))
+	var acc uint64
+	var accBits int
+	for _, delta := range deltas {
+		for written := 0; written < width; {
+			n := width - written
+			if n > 64-accBits {
+				n = 64 - accBits
+			}
+			acc |= ((delta >> uint(written)) & (1<<uint(n) - 1)) << uint(accBits)
+			accBits += n
+			written += n
+			if accBits == 64 {
+				data = binary.LittleEndian.AppendUint64(data, acc)
+				acc, accBits = 0, 0
+			}
+		}
+	}
+	for ; accBits > 0; accBits -= 8 {
+		data = append(data, byte(acc))
+		acc >>= 8
+	}
+	return data, nil
+}
+
+func (this IntListEncoding) decode(data []byte) ([]int64, error) {
+	if len(data) < 1 {
+		return nil, errors.New("int list data is empty")
+	}
+	flags := data[0]
+	data = data[1:]
+	count, n := binary.Uvarint(data)
+	if n <= 0 || count > maxIntListCount {
+		return nil, errors.New("int list count invalid")
+	}
+	data = data[n:]
+	if count == 0 {
+		return []int64{}, nil
+	}
+	first, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, errors.New("int list first value invalid")
+	}
+	data = data[n:]
+
+	// 每个差值至少占1个字节(varint)或者width个bit
+	var width int
+	if flags&intListFlagBitPacked != 0 {
+		if len(data) < 1 || data[0] == 0 || data[0] > 64 {
+			return nil, errors.New("int list bit width invalid")
+		}
+		width = int(data[0])
+		data = data[1:]
+		if count-1 > uint64(len(data))*8/uint64(width) {
+			return nil, errors.New("int list packed data truncated")
+		}
+	} else if count-1 > uint64(len(data)) {
+		return nil, errors.New("int list data truncated")
+	}
+
+	values := make([]int64, count)
+	values[0] = zigzagDecode(first)
+	var bitOffset int
+	for i := 1; i < len(values); i++ {
+		var delta uint64
+		if flags&intListFlagBitPacked != 0 {
+			for read := 0; read < width; {
+				b := data[bitOffset/8]
+				shift := bitOffset % 8
+				n := 8 - shift
+				if n > width-read {
+					n = width - read
+				}
+				delta |= uint64(b>>uint(shift)&(1<<uint(n)-1)) << uint(read)
+				read += n
+				bitOffset += n
+			}
+		} else {
+			delta, n = binary.Uvarint(data)
+			if n <= 0 {
+				return nil, errors.New("int list delta invalid")
+			}
+			data = data[n:]
+		}
+		if flags&intListFlagSorted == 0 {
+			delta = uint64(zigzagDecode(delta))
+		}
+		values[i] = int64(uint64(values[i-1]) + delta)
+	}
+	return values, nil
+}
+
+func (this IntListEncoding) UnmarshalString(data string, value interface{}) error {
+	return this.Unmarshal(stringBytes(data), value)
+}
+
+func (this IntListEncoding) Unmarshal(data []byte, value interface{}) error {
+	values, err := this.decode(data)
+	if err != nil {
+		return err
+	}
+	switch result := value.(type) {
+	case *[]int64:
+		*result = values
+	case *[]int32:
+		list := make([]int32, len(values))
+		for i, v := range values {
+			if v < math.MinInt32 || v > math.MaxInt32 {
+				return errors.Newf("int list value %d overflows int32", v)
+			}
+			list[i] = int32(v)
+		}
+		*result = list
+	case *[]int:
+		list := make([]int, len(values))
+		for i, v := range values {
+			if int64(int(v)) != v {
+				return errors.Newf("int list value %d overflows int", v)
+			}
+			list[i] = int(v)
+		}
+		*result = list
+	default:
+		return errors.Newf("int list encoding unsupported type %v", reflect.TypeOf(value))
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"reflect"
+
+	"github.com/dropbox/godropbox/errors"
+	"github.com/golang/protobuf/proto"
+)
+
+// ProtobufEncoding 支持任意proto.Message(包括gogo-protobuf生成的类型)，
+// 不是proto.Message但是有Marshal()/Unmarshal()方法的类型也可以使用
+type ProtobufEncoding struct {
+}
+
+type protoMarshaler interface {
+	Marshal() ([]byte, error)
+}
+
+type protoUnmarshaler interface {
+	Unmarshal(data []byte) error
+}
+
+func (this ProtobufEncoding) Marshal(v interface{}) ([]byte, error) {
+	v = addressable(v)
+	switch m := v.(type) {
+	case proto.Message:
+		return proto.Marshal(m)
+	case protoMarshaler:
+		return m.Marshal()
+	default:
+		return nil, errors.Newf("protobuf encoding unsupported type %v", reflect.TypeOf(v))
+	}
+}
+
+func (this ProtobufEncoding) Unmarshal(data []byte, value interface{}) error {
+	switch m := value.(type) {
+	case proto.Message:
+		return proto.Unmarshal(data, m)
+	case protoUnmarshaler:
+		return m.Unmarshal(data)
+	default:
+		return errors.Newf("protobuf encoding unsupported type %v", reflect.TypeOf(value))
+	}
+}
+
+// addressable 生成的protobuf方法都定义在指针上，传入值的时候复制一份取地址
+func addressable(v interface{}) interface{} {
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() || rv.Kind() == reflect.Ptr {
+		return v
+	}
+	ptr := reflect.New(rv.Type())
+	ptr.Elem().Set(rv)
+	return ptr.Interface()
+}
@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// Int32SliceStruct 相当于protoc-gen-gogo为下面的message生成的代码(只保留用到的方法)，
+// Marshal/Unmarshal是gogo生成的快速路径，proto.Marshal按struct tag走反射
+//
+//	message Int32SliceStruct {
+//	    repeated int32 data = 1;
+//	}
+type Int32SliceStruct struct {
+	Data []int32 `protobuf:"varint,1,rep,packed,name=data,proto3" json:"data,omitempty"`
+}
+
+func (m *Int32SliceStruct) Reset()         { *m = Int32SliceStruct{} }
+func (m *Int32SliceStruct) String() string { return proto.CompactTextString(m) }
+func (*Int32SliceStruct) ProtoMessage()    {}
+
+func (m *Int32SliceStruct) Marshal() ([]byte, error) {
+	if len(m.Data) == 0 {
+		return []byte{}, nil
+	}
+	packed := make([]byte, 0, binary.MaxVarintLen64*len(m.Data))
+	for _, v := range m.Data {
+		packed = binary.AppendUvarint(packed, uint64(v))
+	}
+	data := make([]byte, 0, 1+binary.MaxVarintLen64+len(packed))
+	data = append(data, 1<<3|2)
+	data = binary.AppendUvarint(data, uint64(len(packed)))
+	return append(data, packed...), nil
+}
+
+var errInt32SliceStructInvalid = errors.New("proto: Int32SliceStruct invalid data")
+
+func (m *Int32SliceStruct) Unmarshal(data []byte) error {
+	m.Reset()
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 || tag>>3 != 1 {
+			return errInt32SliceStructInvalid
+		}
+		data = data[n:]
+		switch tag & 7 {
+		case 0:
+			v, n := binary.Uvarint(data)
+			if n <= 0 {
+				return errInt32SliceStructInvalid
+			}
+			m.Data = append(m.Data, int32(v))
+			data = data[n:]
+		case 2:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || size > uint64(len(data)-n) {
+				return errInt32SliceStructInvalid
+			}
+			packed := data[n : n+int(size)]
+			data = data[n+int(size):]
+			for len(packed) > 0 {
+				v, n := binary.Uvarint(packed)
+				if n <= 0 {
+					return errInt32SliceStructInvalid
+				}
+				m.Data = append(m.Data, int32(v))
+				packed = packed[n:]
+			}
+		default:
+			return errInt32SliceStructInvalid
+		}
+	}
+	return nil
+}
+
+func TestProtobufEncoding(t *testing.T) {
+	encoding := ProtobufEncoding{}
+	for _, message := range []Int32SliceStruct{
+		{},
+		{Data: []int32{1}},
+		{Data: []int32{0, 1, 300, -1, 2147483647, -2147483648}},
+	} {
+		expected, err := proto.Marshal(&message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 传入值时复制一份取地址
+		data, err := encoding.Marshal(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != string(expected) {
+			t.Errorf("generated Marshal and proto.Marshal should agree, %x != %x", data, expected)
+		}
+		var result Int32SliceStruct
+		if err := encoding.Unmarshal(data, &result); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(result.Data, message.Data) {
+			t.Errorf("round trip expected %v, got %v", message.Data, result.Data)
+		}
+	}
+
+	if _, err := encoding.Marshal("not a message"); err == nil {
+		t.Error("marshal non-protobuf value should fail")
+	}
+	var result Int32SliceStruct
+	if err := encoding.Unmarshal([]byte{1<<3 | 2, 10, 1}, &result); err == nil {
+		t.Error("unmarshal truncated data should fail")
+	}
+}
+
+func TestRedisStorageProtobuf(t *testing.T) {
+	ctx := context.Background()
+	storage := NewRedisStorage(newMockRedisClient(), "pb", 0, ProtobufEncoding{}, func() interface{} { return new(Int32SliceStruct) }, false)
+	message := &Int32SliceStruct{Data: []int32{3, 1, 4, 1, 5, 9, 2, 6}}
+	if err := storage.Set(ctx, Int(1), message); err != nil {
+		t.Fatal(err)
+	}
+	var result Int32SliceStruct
+	if err := storage.Get(ctx, Int(1), &result); err != nil || !reflect.DeepEqual(result.Data, message.Data) {
+		t.Errorf("get expected %v, got %v err=%v", message.Data, result.Data, err)
+	}
+	values := make(map[Key]interface{})
+	if err := storage.MultiGet(ctx, []Key{Int(1), Int(2)}, values); err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 1 || !reflect.DeepEqual(values[Int(1)].(*Int32SliceStruct).Data, message.Data) {
+		t.Errorf("MultiGet expected %v, got %v", message.Data, values)
+	}
+}
@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// EncodingID 写在value envelope中，用来在读取时识别payload的Encoding，
+// 已经使用的id不能修改含义
+type EncodingID byte
+
+const (
+	JsonEncodingID EncodingID = iota + 1
+	GobEncodingID
+	JsonGzipEncodingID
+	Int64EncodingID
+	IntEncodingID
+	StringEncodingID
+	JSONSnappyEncodingID
+	MsgPackEncodingID
+	JsonZstdEncodingID
+	JsonLZ4EncodingID
+	ProtobufEncodingID
+	CBOREncodingID
+	IntListEncodingID
+	ScalarEncodingID
+	MsgPackDeterministicEncodingID
+	CBORDeterministicEncodingID
+	IntListBitPackedEncodingID
+)
+
+// UserEncodingIDStart 之后的id留给业务自己注册的Encoding
+const UserEncodingIDStart EncodingID = 128
+
+type RegisteredEncoding struct {
+	ID       EncodingID
+	Name     string
+	Encoding Encoding
+}
+
+var (
+	encodingRegistryLock sync.RWMutex
+	encodingsByID        = make(map[EncodingID]RegisteredEncoding)
+	encodingIDsByType    = make(map[reflect.Type][]EncodingID)
+)
+
+func init() {
+	RegisterEncoding(JsonEncodingID, "json", JsonEncoding{})
+	RegisterEncoding(GobEncodingID, "gob", GobEncoding{})
+	RegisterEncoding(JsonGzipEncodingID, "json_gzip", JsonGzipEncoding{})
+	RegisterEncoding(Int64EncodingID, "int64", Int64Encoding{})
+	RegisterEncoding(IntEncodingID, "int", IntEncoding{})
+	RegisterEncoding(StringEncodingID, "string", StringEncoding{})
+	RegisterEncoding(JSONSnappyEncodingID, "json_snappy", JSONSnappyEncoding{})
+	RegisterEncoding(MsgPackEncodingID, "msgpack", MsgPackEncoding{})
+	RegisterEncoding(JsonZstdEncodingID, "json_zstd", CompressEncoding{JsonEncoding{}, ZstdCompressor{}})
+	RegisterEncoding(JsonLZ4EncodingID, "json_lz4", CompressEncoding{JsonEncoding{}, LZ4Compressor{}})
+	RegisterEncoding(ProtobufEncodingID, "protobuf", ProtobufEncoding{})
+	RegisterEncoding(CBOREncodingID, "cbor", CBOREncoding{})
+	RegisterEncoding(IntListEncodingID, "int_list", IntListEncoding{})
+	RegisterEncoding(ScalarEncodingID, "scalar", ScalarEncoding{})
+	RegisterEncoding(MsgPackDeterministicEncodingID, "msgpack_deterministic", MsgPackEncoding{Deterministic: true})
+	RegisterEncoding(CBORDeterministicEncodingID, "cbor_deterministic", CBOREncoding{Deterministic: true})
+	RegisterEncoding(IntListBitPackedEncodingID, "int_list_bitpacked", IntListEncoding{BitPacking: true})
+}
+
+// RegisterEncoding 注册一个Encoding，id重复时panic。
+// 写入时按值相等查找id，同一个类型的不同配置(比如不同内层Encoding或Compressor的CompressEncoding，
+// 带字典的ZstdCompressor)都要用各自的id注册，否则没有id
+func RegisterEncoding(id EncodingID, name string, e Encoding) {
+	if e == nil {
+		panic("storage: RegisterEncoding encoding is nil")
+	}
+	encodingRegistryLock.Lock()
+	defer encodingRegistryLock.Unlock()
+	if registered, ok := encodingsByID[id]; ok {
+		panic(fmt.Sprintf("storage: RegisterEncoding called twice for id %d (%s, %s)", id, registered.Name, name))
+	}
+	encodingsByID[id] = RegisteredEncoding{ID: id, Name: name, Encoding: e}
+	typ := reflect.TypeOf(e)
+	encodingIDsByType[typ] = append(encodingIDsByType[typ], id)
+}
+
+func GetEncoding(id EncodingID) (Encoding, bool) {
+	encodingRegistryLock.RLock()
+	defer encodingRegistryLock.RUnlock()
+	registered, ok := encodingsByID[id]
+	return registered.Encoding, ok
+}
+
+func GetEncodingByName(name string) (Encoding, bool) {
+	encodingRegistryLock.RLock()
+	defer encodingRegistryLock.RUnlock()
+	for _, registered := range encodingsByID {
+		if registered.Name == name {
+			return registered.Encoding, true
+		}
+	}
+	return nil, false
+}
+
+// EncodingIDOf 返回和e相等的已注册Encoding的id，没有相等的返回false
+func EncodingIDOf(e Encoding) (EncodingID, bool) {
+	if e == nil {
+		return 0, false
+	}
+	encodingRegistryLock.RLock()
+	defer encodingRegistryLock.RUnlock()
+	for _, id := range encodingIDsByType[reflect.TypeOf(e)] {
+		if encodingEqual(encodingsByID[id].Encoding, e) {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// encodingEqual 比较两个同类型的Encoding，不可比较的类型用reflect.DeepEqual
+func encodingEqual(a, b Encoding) (equal bool) {
+	defer func() {
+		if recover() != nil {
+			// 可比较的struct中的interface字段保存了不可比较的值
+			equal = reflect.DeepEqual(a, b)
+		}
+	}()
+	if !reflect.TypeOf(a).Comparable() {
+		return reflect.DeepEqual(a, b)
+	}
+	return a == b
+}
+
+// RegisteredEncodings 按id顺序返回所有注册的Encoding
+func RegisteredEncodings() []RegisteredEncoding {
+	encodingRegistryLock.RLock()
+	defer encodingRegistryLock.RUnlock()
+	result := make([]RegisteredEncoding, 0, len(encodingsByID))
+	for _, registered := range encodingsByID {
+		result = append(result, registered)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ScalarEncoding 把标量编码成文本，整数的格式和redis INCR兼容。
+// 支持所有int/uint, float32/64, bool, string, []byte, time.Time(RFC3339Nano), time.Duration(纳秒整数)，
+// Marshal接受值或指针，Unmarshal接受指针，类型不支持时返回UnsupportedTypeError，解析失败返回ScalarDecodeError
+type ScalarEncoding struct {
+}
+
+// UnsupportedTypeError Encoding不支持的类型
+type UnsupportedTypeError struct {
+	Encoding string
+	Type     reflect.Type
+}
+
+func (this UnsupportedTypeError) Error() string {
+	return fmt.Sprintf("%s does not support type %v", this.Encoding, this.Type)
+}
+
+// ScalarDecodeError 数据不能解析成目标类型
+type ScalarDecodeError struct {
+	Type reflect.Type
+	Data string
+	Err  error
+}
+
+func (this ScalarDecodeError) Error() string {
+	return fmt.Sprintf("can not decode %q into %v: %v", this.Data, this.Type, this.Err)
+}
+
+func (this ScalarDecodeError) Is(target error) bool {
+	return target == ErrDecode
+}
+
+func (this ScalarDecodeError) Unwrap() error {
+	return this.Err
+}
+
+type scalarKind int
+
+const (
+	scalarInt scalarKind = 1 << iota
+	scalarUint
+	scalarFloat
+	scalarBool
+	scalarString
+	scalarBytes
+	scalarTime
+	scalarDuration
+
+	scalarInteger = scalarInt | scalarUint
+	scalarAll     = scalarInt | scalarUint | scalarFloat | scalarBool | scalarString | scalarBytes | scalarTime | scalarDuration
+)
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	durationType = reflect.TypeOf(time.Duration(0))
+	bytesType    = reflect.TypeOf([]byte(nil))
+)
+
+func scalarKindOf(typ reflect.Type) scalarKind {
+	switch typ {
+	case timeType:
+		return scalarTime
+	case durationType:
+		return scalarDuration
+	case bytesType:
+		return scalarBytes
+	}
+	switch typ.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return scalarInt
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return scalarUint
+	case reflect.Float32, reflect.Float64:
+		return scalarFloat
+	case reflect.Bool:
+		return scalarBool
+	case reflect.String:
+		return scalarString
+	}
+	return 0
+}
+
+func marshalScalar(name string, kinds scalarKind, v interface{}) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if !rv.IsValid() || rv.Kind() == reflect.Ptr {
+		return nil, UnsupportedTypeError{name, reflect.TypeOf(v)}
+	}
+	kind := scalarKindOf(rv.Type())
+	if kind&kinds == 0 {
+		return nil, UnsupportedTypeError{name, reflect.TypeOf(v)}
+	}
+	switch kind {
+	case scalarTime:
+		return rv.Interface().(time.Time).AppendFormat(nil, time.RFC3339Nano), nil
+	case scalarDuration, scalarInt:
+		return strconv.AppendInt(nil, rv.Int(), 10), nil
+	case scalarUint:
+		return strconv.AppendUint(nil, rv.Uint(), 10), nil
+	case scalarFloat:
+		return strconv.AppendFloat(nil, rv.Float(), 'g', -1, rv.Type().Bits()), nil
+	case scalarBool:
+		return strconv.AppendBool(nil, rv.Bool()), nil
+	case scalarString:
+		return []byte(rv.String()), nil
+	case scalarBytes:
+		return append([]byte(nil), rv.Bytes()...), nil
+	}
+	return nil, UnsupportedTypeError{name, reflect.TypeOf(v)}
+}
+
+func unmarshalScalar(name string, kinds scalarKind, data string, value interface{}) error {
+	rv := reflect.ValueOf(value)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return UnsupportedTypeError{name, reflect.TypeOf(value)}
+	}
+	rv = rv.Elem()
+	typ := rv.Type()
+	kind := scalarKindOf(typ)
+	if kind&kinds == 0 {
+		return UnsupportedTypeError{name, reflect.TypeOf(value)}
+	}
+	var err error
+	switch kind {
+	case scalarTime:
+		var t time.Time
+		t, err = time.Parse(time.RFC3339Nano, data)
+		if err == nil {
+			rv.Set(reflect.ValueOf(t))
+		}
+	case scalarDuration, scalarInt:
+		var i int64
+		i, err = strconv.ParseInt(data, 10, typ.Bits())
+		if err == nil {
+			rv.SetInt(i)
+		}
+	case scalarUint:
+		var u uint64
+		u, err = strconv.ParseUint(data, 10, typ.Bits())
+		if err == nil {
+			rv.SetUint(u)
+		}
+	case scalarFloat:
+		var f float64
+		f, err = strconv.ParseFloat(data, typ.Bits())
+		if err == nil {
+			rv.SetFloat(f)
+		}
+	case scalarBool:
+		var b bool
+		b, err = strconv.ParseBool(data)
+		if err == nil {
+			rv.SetBool(b)
+		}
+	case scalarString:
+		rv.SetString(strings.Clone(data))
+	case scalarBytes:
+		rv.SetBytes([]byte(data))
+	}
+	if err != nil {
+		return ScalarDecodeError{Type: typ, Data: strings.Clone(data), Err: err}
+	}
+	return nil
+}
+
+func (this ScalarEncoding) Marshal(v interface{}) ([]byte, error) {
+	return marshalScalar("ScalarEncoding", scalarAll, v)
+}
+
+func (this ScalarEncoding) Unmarshal(data []byte, value interface{}) error {
+	return unmarshalScalar("ScalarEncoding", scalarAll, string(data), value)
+}
+
+func (this ScalarEncoding) UnmarshalString(data string, value interface{}) error {
+	return unmarshalScalar("ScalarEncoding", scalarAll, data, value)
+}
@@ -6,7 +6,16 @@ package storage
 // BenchmarkPBMarshal-4       	  500000	      2955 ns/op
 // BenchmarkPBUnmarshal-4     	  300000	      3820 ns/op
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
 
 type Int32SliceStructEncoding struct {
 }
@@ -128,3 +137,429 @@ func BenchmarkPBUnmarshal(b *testing.B) {
 
 	}
 }
+
+func BenchmarkProtobufEncodingMarshal(b *testing.B) {
+	a := make([]int32, 0, 400)
+	for i := 0; i < 400; i++ {
+		a = append(a, int32(i))
+	}
+	protobufEncoding := ProtobufEncoding{}
+	intSliceStruct := Int32SliceStruct{
+		Data: a,
+	}
+	for n := 0; n < b.N; n++ {
+		_, err := protobufEncoding.Marshal(&intSliceStruct)
+		if err != nil {
+			b.Error(err)
+		}
+	}
+}
+
+func BenchmarkProtobufEncodingUnmarshal(b *testing.B) {
+	a := make([]int32, 0, 400)
+	for i := 0; i < 400; i++ {
+		a = append(a, int32(i))
+	}
+	protobufEncoding := ProtobufEncoding{}
+	data, err := protobufEncoding.Marshal(Int32SliceStruct{Data: a})
+	if err != nil {
+		b.Error(err)
+	}
+	var result Int32SliceStruct
+	for n := 0; n < b.N; n++ {
+		err = protobufEncoding.Unmarshal(data, &result)
+		if err != nil {
+			b.Error(err)
+		}
+	}
+}
+
+func TestAdaptiveCompressEncoding(t *testing.T) {
+	stats := &CompressionStats{}
+	encoding := AdaptiveCompressEncoding{
+		Encoding:   JsonEncoding{},
+		Compressor: GzipCompressor{},
+		Threshold:  64,
+		Stats:      stats,
+	}
+
+	small := []int{1, 2, 3}
+	data, err := encoding.Marshal(small)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[0] != adaptiveFlagRaw {
+		t.Errorf("small value should not be compressed")
+	}
+
+	large := make([]int, 400)
+	data, err = encoding.Marshal(large)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[0] != adaptiveFlagCompressed {
+		t.Errorf("large value should be compressed")
+	}
+	var result []int
+	if err = encoding.Unmarshal(data, &result); err != nil || len(result) != 400 {
+		t.Errorf("unmarshal compressed value failed, len=%d err=%v", len(result), err)
+	}
+
+	snapshot := stats.Snapshot()
+	if snapshot.Total != 2 || snapshot.Compressed != 1 || snapshot.CompressedRatio() <= 1 {
+		t.Errorf("unexpected stats %+v", snapshot)
+	}
+}
+
+var registerTestEncodingOnce sync.Once
+
+func TestEncodingIDOf(t *testing.T) {
+	if id, ok := EncodingIDOf(CompressEncoding{JsonEncoding{}, ZstdCompressor{}}); !ok || id != JsonZstdEncodingID {
+		t.Errorf("json zstd should be %d, got %d %v", JsonZstdEncodingID, id, ok)
+	}
+	if id, ok := EncodingIDOf(MsgPackEncoding{Deterministic: true}); !ok || id != MsgPackDeterministicEncodingID {
+		t.Errorf("deterministic msgpack should be %d, got %d %v", MsgPackDeterministicEncodingID, id, ok)
+	}
+
+	msgpackSnappy := CompressEncoding{MsgPackEncoding{}, SnappyCompressor{}}
+	storage := NewRedisStorage(newMockRedisClient(), "registry", 0, msgpackSnappy, nil, false)
+	storage.WriteEnvelope = true
+	// 没有注册的配置不能用同类型的其它id(-count大于1时已经注册过)
+	if _, registered := GetEncoding(UserEncodingIDStart); !registered {
+		if id, ok := EncodingIDOf(msgpackSnappy); ok {
+			t.Errorf("unregistered msgpack snappy should have no id, got %d", id)
+		}
+		if err := storage.Set(context.Background(), String("1"), "a"); err == nil {
+			t.Errorf("set with unregistered encoding and WriteEnvelope should fail")
+		}
+	}
+
+	registerTestEncodingOnce.Do(func() {
+		RegisterEncoding(UserEncodingIDStart, "test_msgpack_snappy", msgpackSnappy)
+	})
+	if id, ok := EncodingIDOf(msgpackSnappy); !ok || id != UserEncodingIDStart {
+		t.Errorf("registered msgpack snappy should be %d, got %d %v", UserEncodingIDStart, id, ok)
+	}
+	if err := storage.Set(context.Background(), String("1"), "a"); err != nil {
+		t.Fatal(err)
+	}
+	var value string
+	if err := storage.Get(context.Background(), String("1"), &value); err != nil || value != "a" {
+		t.Errorf("value written with envelope should be read back, value=%q err=%v", value, err)
+	}
+}
+
+func TestIntListEncoding(t *testing.T) {
+	lists := [][]int64{
+		{},
+		{42},
+		{1, 2, 3, 5, 8, 13, 21},
+		{100, -3, 7, 7, 0, -9223372036854775808, 9223372036854775807},
+		{7, 7, 7, 7},
+	}
+	for _, bitPacking := range []bool{false, true} {
+		encoding := IntListEncoding{BitPacking: bitPacking}
+		for _, list := range lists {
+			data, err := encoding.Marshal(list)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var result []int64
+			if err = encoding.Unmarshal(data, &result); err != nil {
+				t.Fatal(err)
+			}
+			if len(result) != len(list) {
+				t.Fatalf("bitPacking=%v expected %v, got %v", bitPacking, list, result)
+			}
+			for i := range list {
+				if result[i] != list[i] {
+					t.Fatalf("bitPacking=%v expected %v, got %v", bitPacking, list, result)
+				}
+			}
+		}
+	}
+
+	var int32Result []int32
+	data, _ := IntListEncoding{}.Marshal([]int64{1 << 40})
+	if err := (IntListEncoding{}).Unmarshal(data, &int32Result); err == nil {
+		t.Error("unmarshal overflowing value into []int32 should fail")
+	}
+}
+
+func TestIntListEncodingCorrupt(t *testing.T) {
+	corrupts := map[string][]byte{
+		"empty":                 {},
+		"count overflow":        {intListFlagSorted, 0xff, 0xff, 0xff, 0xff, 0x0f, 0},
+		"varint truncated":      {intListFlagSorted, 100, 0, 1},
+		"width 0":               {intListFlagSorted | intListFlagBitPacked, 0xc0, 0x84, 0x3d, 0, 0},
+		"width 65":              {intListFlagSorted | intListFlagBitPacked, 2, 0, 65, 1},
+		"packed data truncated": {intListFlagSorted | intListFlagBitPacked, 10, 0, 8, 1, 2},
+	}
+	for _, bitPacking := range []bool{false, true} {
+		encoding := IntListEncoding{BitPacking: bitPacking}
+		data, err := encoding.Marshal([]int64{3, 1, 4, 1, 5, 9, 2, 6})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < len(data); i++ {
+			corrupts[fmt.Sprintf("bitPacking=%v prefix %d", bitPacking, i)] = data[:i]
+		}
+	}
+	for name, data := range corrupts {
+		var result []int64
+		if err := (IntListEncoding{}).Unmarshal(data, &result); err == nil {
+			t.Errorf("%s: corrupt data should fail, got %v", name, result)
+		}
+	}
+}
+
+func benchmarkIntList() []int64 {
+	a := make([]int64, 0, 400)
+	for i := 0; i < 400; i++ {
+		a = append(a, int64(100000000+i*3))
+	}
+	return a
+}
+
+func benchmarkIntListMarshal(b *testing.B, encoding Encoding) {
+	a := benchmarkIntList()
+	data, err := encoding.Marshal(a)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		_, err := encoding.Marshal(a)
+		if err != nil {
+			b.Error(err)
+		}
+	}
+	b.ReportMetric(float64(len(data)), "bytes")
+}
+
+func benchmarkIntListUnmarshal(b *testing.B, encoding Encoding) {
+	data, err := encoding.Marshal(benchmarkIntList())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	var result []int64
+	for n := 0; n < b.N; n++ {
+		err = encoding.Unmarshal(data, &result)
+		if err != nil {
+			b.Error(err)
+		}
+	}
+}
+
+func BenchmarkIntListMarshal(b *testing.B) {
+	benchmarkIntListMarshal(b, IntListEncoding{})
+}
+
+func BenchmarkIntListBitPackingMarshal(b *testing.B) {
+	benchmarkIntListMarshal(b, IntListEncoding{BitPacking: true})
+}
+
+func BenchmarkIntListMsgpackMarshal(b *testing.B) {
+	benchmarkIntListMarshal(b, MsgPackEncoding{})
+}
+
+func BenchmarkIntListJsonMarshal(b *testing.B) {
+	benchmarkIntListMarshal(b, JsonEncoding{})
+}
+
+func BenchmarkIntListUnmarshal(b *testing.B) {
+	benchmarkIntListUnmarshal(b, IntListEncoding{})
+}
+
+func BenchmarkIntListBitPackingUnmarshal(b *testing.B) {
+	benchmarkIntListUnmarshal(b, IntListEncoding{BitPacking: true})
+}
+
+func BenchmarkIntListMsgpackUnmarshal(b *testing.B) {
+	benchmarkIntListUnmarshal(b, MsgPackEncoding{})
+}
+
+func BenchmarkIntListJsonUnmarshal(b *testing.B) {
+	benchmarkIntListUnmarshal(b, JsonEncoding{})
+}
+
+func TestScalarEncoding(t *testing.T) {
+	encoding := ScalarEncoding{}
+	now := time.Now()
+	var (
+		i8  int8    = -8
+		u64 uint64  = 1<<64 - 1
+		f32 float32 = 1.5
+		b           = true
+		d           = 3 * time.Second
+	)
+	cases := []struct {
+		value  interface{}
+		result interface{}
+	}{
+		{i8, new(int8)},
+		{&u64, new(uint64)},
+		{f32, new(float32)},
+		{&b, new(bool)},
+		{d, new(time.Duration)},
+		{now, new(time.Time)},
+		{[]byte("raw"), new([]byte)},
+		{"str", new(string)},
+	}
+	for _, c := range cases {
+		data, err := encoding.Marshal(c.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = encoding.Unmarshal(data, c.result); err != nil {
+			t.Fatal(err)
+		}
+		expected := reflect.ValueOf(c.value)
+		if expected.Kind() == reflect.Ptr {
+			expected = expected.Elem()
+		}
+		actual := reflect.ValueOf(c.result).Elem().Interface()
+		if tm, ok := actual.(time.Time); ok {
+			if !tm.Equal(now) {
+				t.Errorf("expected %v, got %v", now, tm)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(expected.Interface(), actual) {
+			t.Errorf("expected %v, got %v", expected.Interface(), actual)
+		}
+	}
+
+	if _, err := (Int64Encoding{}).Marshal("1"); err == nil {
+		t.Error("Int64Encoding should not marshal string")
+	}
+	var s string
+	if err := (Int64Encoding{}).Unmarshal([]byte("1"), &s); err == nil {
+		t.Error("Int64Encoding should not unmarshal into string")
+	}
+	var i int
+	if err := (Int64Encoding{}).Unmarshal([]byte("1"), &i); err != nil || i != 1 {
+		t.Errorf("Int64Encoding should unmarshal into int, got %d err=%v", i, err)
+	}
+	var i32 int32
+	if err := encoding.Unmarshal([]byte("4294967296"), &i32); err == nil {
+		t.Error("overflowing value should fail")
+	}
+	if err := encoding.Unmarshal([]byte("1"), i32); err == nil {
+		t.Error("non-pointer target should fail instead of panic")
+	}
+}
+
+type deterministicSample struct {
+	Name   string            `json:"name" msgpack:"name" cbor:"name"`
+	Scores map[string]int64  `json:"scores" msgpack:"scores" cbor:"scores"`
+	Labels map[string]string `json:"labels" msgpack:"labels" cbor:"labels"`
+	Ratio  float64           `json:"ratio" msgpack:"ratio" cbor:"ratio"`
+	Names  map[int64]string  `json:"-" msgpack:"names" cbor:"names"`
+}
+
+// deterministicSamples 返回内容相同、插入顺序不同的两个对象
+func deterministicSamples() (deterministicSample, deterministicSample) {
+	a := deterministicSample{Name: "a", Scores: map[string]int64{}, Labels: map[string]string{}, Ratio: 1.5, Names: map[int64]string{}}
+	b := deterministicSample{Name: "a", Scores: map[string]int64{}, Labels: map[string]string{}, Ratio: 1.5, Names: map[int64]string{}}
+	for i := 0; i < 64; i++ {
+		a.Scores[strconv.Itoa(i)] = int64(i)
+		b.Scores[strconv.Itoa(63-i)] = int64(63 - i)
+		a.Labels["k"+strconv.Itoa(i)] = strconv.Itoa(i * i)
+		a.Names[int64(i*1000)] = strconv.Itoa(i)
+		b.Names[int64((63-i)*1000)] = strconv.Itoa(63 - i)
+	}
+	for i := 63; i >= 0; i-- {
+		b.Labels["k"+strconv.Itoa(i)] = strconv.Itoa(i * i)
+	}
+	return a, b
+}
+
+func TestDeterministicEncoding(t *testing.T) {
+	for name, encoding := range map[string]Encoding{
+		"msgpack": MsgPackEncoding{Deterministic: true},
+		"cbor":    CBOREncoding{Deterministic: true},
+	} {
+		if !IsDeterministicEncoding(encoding) {
+			t.Errorf("%s should be deterministic", name)
+		}
+		a, b := deterministicSamples()
+		expected, err := encoding.Marshal(a)
+		if err != nil {
+			t.Fatalf("%s marshal error %v", name, err)
+		}
+		// map的遍历顺序是随机的，多次序列化检查
+		for i := 0; i < 20; i++ {
+			for _, value := range []deterministicSample{a, b} {
+				data, err := encoding.Marshal(value)
+				if err != nil {
+					t.Fatalf("%s marshal error %v", name, err)
+				}
+				if !bytes.Equal(data, expected) {
+					t.Fatalf("%s output should be byte-for-byte equal regardless of map insertion order", name)
+				}
+			}
+		}
+
+		var result deterministicSample
+		if err := encoding.Unmarshal(expected, &result); err != nil || !reflect.DeepEqual(result, a) {
+			t.Errorf("%s round trip failed, result=%+v err=%v", name, result, err)
+		}
+		result = deterministicSample{}
+		if su, ok := encoding.(StringUnmarshaler); !ok {
+			t.Errorf("%s should implement StringUnmarshaler", name)
+		} else if err := su.UnmarshalString(string(expected), &result); err != nil || !reflect.DeepEqual(result, a) {
+			t.Errorf("%s string round trip failed, result=%+v err=%v", name, result, err)
+		}
+	}
+}
+
+func TestNonDeterministicEncodingRoundTrip(t *testing.T) {
+	for name, encoding := range map[string]Encoding{
+		"msgpack": MsgPackEncoding{},
+		"cbor":    CBOREncoding{},
+	} {
+		if IsDeterministicEncoding(encoding) {
+			t.Errorf("%s without Deterministic should not be deterministic", name)
+		}
+		a, _ := deterministicSamples()
+		data, err := encoding.Marshal(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result deterministicSample
+		if err := encoding.Unmarshal(data, &result); err != nil || !reflect.DeepEqual(result, a) {
+			t.Errorf("%s round trip failed, result=%+v err=%v", name, result, err)
+		}
+	}
+
+	// 不同的Deterministic设置写入的数据可以互相读取
+	a, _ := deterministicSamples()
+	data, _ := CBOREncoding{Deterministic: true}.Marshal(a)
+	var result deterministicSample
+	if err := (CBOREncoding{}).Unmarshal(data, &result); err != nil || !reflect.DeepEqual(result, a) {
+		t.Errorf("deterministic cbor should be readable by default cbor, err=%v", err)
+	}
+}
+
+func TestCanonicalMsgpackCorrupt(t *testing.T) {
+	data, err := MsgPackEncoding{}.Marshal(map[string]interface{}{"a": []int{1, 2}, "b": map[int]string{1: "x"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(data); i++ {
+		if _, err := canonicalMsgpack(data[:i]); err == nil {
+			t.Errorf("truncated msgpack data %x should fail", data[:i])
+		}
+	}
+	// map32声明了很多entry但是没有数据
+	if _, err := canonicalMsgpack([]byte{0xdf, 0xff, 0xff, 0xff, 0xff}); err == nil {
+		t.Errorf("map with huge count should fail")
+	}
+	if _, err := canonicalMsgpack(append(data, 0x01)); err == nil {
+		t.Errorf("trailing data should fail")
+	}
+}
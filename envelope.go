@@ -0,0 +1,188 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/dropbox/godropbox/errors"
+)
+
+// envelope 是写入redis的value外层的一个小header，
+// 用来携带encoding本身不知道的元数据(比如codec, schema version, soft expire)。
+//
+// layout: magic(2) | flags(1) | [codec(1)] | [schemaVersion(uvarint)] | [softExpireAt(8)] | [checksum(4|8)] | payload
+//
+// 可选字段是否存在由flags决定，不存在的字段不占空间。
+// checksum覆盖checksum之前的header和payload，crc32c占4字节，xxhash占8字节。
+// 不需要元数据的value直接保存payload，读取时不以magic开头的数据整个按payload处理。
+// payload本身可能以magic开头(比如[]byte、string、snappy的长度header)，
+// 这时写入也要加上envelope(flags可以为0)，所以以magic开头的数据一定是envelope。
+const (
+	envelopeMagic0 byte = 0xc1
+	envelopeMagic1 byte = 0x5e
+
+	envelopeHeaderSize = 3
+)
+
+const (
+	envelopeFlagSoftExpire byte = 1 << iota
+	envelopeFlagCodec
+	envelopeFlagSchemaVersion
+	envelopeFlagCRC32C
+	envelopeFlagXXHash
+	envelopeFlagChunked // payload是chunk manifest，见chunk.go
+)
+
+const envelopeKnownFlags = envelopeFlagSoftExpire | envelopeFlagCodec | envelopeFlagSchemaVersion | envelopeFlagCRC32C | envelopeFlagXXHash | envelopeFlagChunked
+
+// ChecksumType 写入value时使用的校验算法
+type ChecksumType byte
+
+const (
+	NoChecksum ChecksumType = iota
+	ChecksumCRC32C
+	ChecksumXXHash
+)
+
+func (this ChecksumType) flag() byte {
+	switch this {
+	case ChecksumCRC32C:
+		return envelopeFlagCRC32C
+	case ChecksumXXHash:
+		return envelopeFlagXXHash
+	default:
+		return 0
+	}
+}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// envelopeChecksum 计算header(不含checksum字段)和payload的checksum
+func envelopeChecksum(flags byte, header, payload []byte) []byte {
+	switch {
+	case flags&envelopeFlagCRC32C != 0:
+		sum := crc32.Update(crc32.Checksum(header, crc32cTable), crc32cTable, payload)
+		var buf [4]byte
+		binary.BigEndian.PutUint32(buf[:], sum)
+		return buf[:]
+	case flags&envelopeFlagXXHash != 0:
+		digest := xxhash.New()
+		digest.Write(header)
+		digest.Write(payload)
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], digest.Sum64())
+		return buf[:]
+	default:
+		return nil
+	}
+}
+
+type envelope struct {
+	flags         byte
+	codec         EncodingID
+	schemaVersion uint32
+	softExpireAt  int64 // unix nano
+	payload       []byte
+
+	upcasted bool // 解码时经过了Upcaster，不写入value
+}
+
+func (this envelope) isStale(now time.Time) bool {
+	return this.flags&envelopeFlagSoftExpire != 0 && now.UnixNano() > this.softExpireAt
+}
+
+func packEnvelope(env envelope) []byte {
+	data := make([]byte, envelopeHeaderSize, envelopeHeaderSize+1+binary.MaxVarintLen32+8+8+len(env.payload))
+	data[0] = envelopeMagic0
+	data[1] = envelopeMagic1
+	data[2] = env.flags
+	if env.flags&envelopeFlagCodec != 0 {
+		data = append(data, byte(env.codec))
+	}
+	if env.flags&envelopeFlagSchemaVersion != 0 {
+		var buf [binary.MaxVarintLen32]byte
+		n := binary.PutUvarint(buf[:], uint64(env.schemaVersion))
+		data = append(data, buf[:n]...)
+	}
+	if env.flags&envelopeFlagSoftExpire != 0 {
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], uint64(env.softExpireAt))
+		data = append(data, buf[:]...)
+	}
+	data = append(data, envelopeChecksum(env.flags, data, env.payload)...)
+	return append(data, env.payload...)
+}
+
+func isEnveloped(data []byte) bool {
+	return len(data) >= envelopeHeaderSize && data[0] == envelopeMagic0 && data[1] == envelopeMagic1
+}
+
+// unpackEnvelope 解析value，不是envelope格式的数据整个当作payload返回，
+// header不合法或者checksum不一致时返回CorruptValueError(Key为空，由调用方填写)
+func unpackEnvelope(data []byte) (env envelope, err error) {
+	if !isEnveloped(data) {
+		env.payload = data
+		return
+	}
+	header := data
+	env.flags = data[2]
+	if env.flags&^envelopeKnownFlags != 0 {
+		return env, CorruptValueError{Reason: fmt.Sprintf("unknown envelope flags %08b", env.flags)}
+	}
+	if env.flags&envelopeFlagCRC32C != 0 && env.flags&envelopeFlagXXHash != 0 {
+		return env, CorruptValueError{Reason: "envelope has more than one checksum"}
+	}
+	data = data[envelopeHeaderSize:]
+	if env.flags&envelopeFlagCodec != 0 {
+		if len(data) < 1 {
+			return env, CorruptValueError{Reason: "envelope codec field truncated"}
+		}
+		env.codec = EncodingID(data[0])
+		data = data[1:]
+	}
+	if env.flags&envelopeFlagSchemaVersion != 0 {
+		version, n := binary.Uvarint(data)
+		if n <= 0 || version > 1<<32-1 {
+			return env, CorruptValueError{Reason: "envelope schema version field invalid"}
+		}
+		env.schemaVersion = uint32(version)
+		data = data[n:]
+	}
+	if env.flags&envelopeFlagSoftExpire != 0 {
+		if len(data) < 8 {
+			return env, CorruptValueError{Reason: "envelope soft expire field truncated"}
+		}
+		env.softExpireAt = int64(binary.BigEndian.Uint64(data))
+		data = data[8:]
+	}
+	if env.flags&(envelopeFlagCRC32C|envelopeFlagXXHash) != 0 {
+		headerSize := len(header) - len(data)
+		expected := envelopeChecksum(env.flags, header[:headerSize], nil)
+		if len(data) < len(expected) {
+			return env, CorruptValueError{Reason: "envelope checksum field truncated"}
+		}
+		payload := data[len(expected):]
+		actual := envelopeChecksum(env.flags, header[:headerSize], payload)
+		if string(actual) != string(data[:len(expected)]) {
+			return env, CorruptValueError{Reason: "checksum mismatch"}
+		}
+		data = payload
+	}
+	env.payload = data
+	return
+}
+
+// encoding 返回payload对应的Encoding，envelope中没有codec时返回fallback
+func (this envelope) encoding(fallback Encoding) (Encoding, error) {
+	if this.flags&envelopeFlagCodec == 0 {
+		return fallback, nil
+	}
+	e, ok := GetEncoding(this.codec)
+	if !ok {
+		return nil, errors.Newf("unregistered encoding id %d", this.codec)
+	}
+	return e, nil
+}
@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnvelopeSoftExpire(t *testing.T) {
+	now := time.Now()
+	data := packEnvelope(envelope{
+		flags:        envelopeFlagSoftExpire,
+		softExpireAt: now.UnixNano(),
+		payload:      []byte(`{"id":1}`),
+	})
+	env, err := unpackEnvelope(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(env.payload, []byte(`{"id":1}`)) {
+		t.Errorf("payload is %q", env.payload)
+	}
+	if env.isStale(now.Add(-time.Second)) {
+		t.Error("entry should be fresh before soft expire")
+	}
+	if !env.isStale(now.Add(time.Second)) {
+		t.Error("entry should be stale after soft expire")
+	}
+}
+
+func TestEnvelopeLegacyValue(t *testing.T) {
+	data := []byte(`{"id":1}`)
+	env, err := unpackEnvelope(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(env.payload, data) || env.isStale(time.Now()) {
+		t.Errorf("legacy value should be returned as fresh payload, got %+v", env)
+	}
+}
+
+func TestEnvelopeCodec(t *testing.T) {
+	storage := RedisStorage{encoding: MsgPackEncoding{}, WriteEnvelope: true}
+	data := packEnvelope(envelope{
+		flags:   envelopeFlagCodec,
+		codec:   JsonEncodingID,
+		payload: []byte(`{"id":1}`),
+	})
+	var value map[string]int
+	env, err := storage.decode("", data, false, &value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.codec != JsonEncodingID || value["id"] != 1 {
+		t.Errorf("decode with envelope codec failed, codec=%d value=%v", env.codec, value)
+	}
+
+	storage.LegacyEncoding = JsonEncoding{}
+	value = nil
+	if _, err = storage.decode("", []byte(`{"id":2}`), false, &value); err != nil {
+		t.Fatal(err)
+	}
+	if value["id"] != 2 {
+		t.Errorf("decode legacy value failed, value=%v", value)
+	}
+
+	// 没有codec的envelope(比如只有checksum)是当前Encoding写入的，不能用LegacyEncoding
+	data, err = RedisStorage{encoding: MsgPackEncoding{}, Checksum: ChecksumCRC32C}.encode("", map[string]int{"id": 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	value = nil
+	if _, err = storage.decode("", data, false, &value); err != nil || value["id"] != 3 {
+		t.Errorf("codec-less envelope should be decoded with current encoding, value=%v err=%v", value, err)
+	}
+}
+
+type unregisteredEncoding struct {
+	JsonEncoding
+}
+
+func TestEnvelopeUnregisteredEncoding(t *testing.T) {
+	storage := RedisStorage{encoding: unregisteredEncoding{}, WriteEnvelope: true}
+	if _, err := storage.encode("", map[string]int{"id": 1}); err == nil {
+		t.Errorf("WriteEnvelope with unregistered encoding should fail at write time")
+	}
+}
+
+func TestEnvelopeChecksum(t *testing.T) {
+	for _, checksum := range []ChecksumType{ChecksumCRC32C, ChecksumXXHash} {
+		data := packEnvelope(envelope{
+			flags:   envelopeFlagCodec | checksum.flag(),
+			codec:   JsonEncodingID,
+			payload: []byte(`{"id":1}`),
+		})
+		env, err := unpackEnvelope(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(env.payload, []byte(`{"id":1}`)) {
+			t.Errorf("payload is %q", env.payload)
+		}
+
+		data[len(data)-2] ^= 0xff
+		if _, err = unpackEnvelope(data); !IsErrorCorrupt(err) {
+			t.Errorf("checksum %d should detect corrupt payload, err=%v", checksum, err)
+		}
+	}
+}
+
+// payload以envelope magic开头时不能被当作envelope解析
+func TestEnvelopeMagicPayload(t *testing.T) {
+	ctx := context.Background()
+	raw := []byte{envelopeMagic0, envelopeMagic1, 0, 'h', 'i'}
+	storage := NewRedisStorage(newMockRedisClient(), "magic", 0, ScalarEncoding{}, nil, false)
+	if err := storage.Set(ctx, String("bytes"), raw); err != nil {
+		t.Fatal(err)
+	}
+	var data []byte
+	if err := storage.Get(ctx, String("bytes"), &data); err != nil || !bytes.Equal(data, raw) {
+		t.Errorf("[]byte starting with envelope magic should be read back, data=%v err=%v", data, err)
+	}
+
+	// 12097字节的json经过snappy后长度header是0xc1 0x5e
+	value := strings.Repeat("a", 12095)
+	storage = NewRedisStorage(newMockRedisClient(), "magic", 0, JSONSnappyEncoding{}, nil, false)
+	buf, err := JSONSnappyEncoding{}.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isEnveloped(buf) {
+		t.Fatalf("snappy payload should start with envelope magic, got %x", buf[:3])
+	}
+	if err := storage.Set(ctx, String("snappy"), value); err != nil {
+		t.Fatal(err)
+	}
+	var result string
+	if err := storage.Get(ctx, String("snappy"), &result); err != nil || result != value {
+		t.Errorf("snappy value starting with envelope magic should be read back, len=%d err=%v", len(result), err)
+	}
+}
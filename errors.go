@@ -0,0 +1,141 @@
+package storage
+
+import (
+	stdcontext "context"
+	stderrors "errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/dropbox/godropbox/errors"
+	"github.com/go-redis/redis"
+)
+
+// 错误分类，storage返回的error都可以用errors.Is判断，比如
+//
+//	if errors.Is(err, storage.ErrNotFound) {...}
+//
+// 被godropbox的errors.Wrap再包装过的error用IsError/AsError判断
+var (
+	ErrNotFound    = stderrors.New("storage: not found")
+	ErrInvalidKey  = stderrors.New("storage: invalid key")
+	ErrDecode      = stderrors.New("storage: decode failure")
+	ErrTimeout     = stderrors.New("storage: timeout")
+	ErrUnavailable = stderrors.New("storage: unavailable")
+)
+
+// kindError 给err加上分类，Error()和err相同，errors.Is对kind和err都成立
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (this kindError) Error() string {
+	return this.err.Error()
+}
+
+func (this kindError) Unwrap() []error {
+	return []error{this.kind, this.err}
+}
+
+func markError(kind, err error) error {
+	if err == nil {
+		return nil
+	}
+	return kindError{kind: kind, err: err}
+}
+
+// dropboxChain 让errors.Is/As可以穿过godropbox的errors.Wrap
+type dropboxChain struct {
+	errors.DropboxError
+}
+
+func (this dropboxChain) Unwrap() error {
+	inner := this.GetInner()
+	if dropboxErr, ok := inner.(errors.DropboxError); ok {
+		return dropboxChain{dropboxErr}
+	}
+	return inner
+}
+
+// wrapError/wrapErrorf 和errors.Wrap/Wrapf一样，返回的error可以用errors.Is/As展开
+func wrapError(err error, msg string) error {
+	return dropboxChain{errors.Wrap(err, msg)}
+}
+
+func wrapErrorf(err error, format string, args ...interface{}) error {
+	return dropboxChain{errors.Wrapf(err, format, args...)}
+}
+
+// IsError 和errors.Is一样，同时展开godropbox的DropboxError
+func IsError(err, target error) bool {
+	for err != nil {
+		if stderrors.Is(err, target) {
+			return true
+		}
+		dropboxErr, ok := err.(errors.DropboxError)
+		if !ok {
+			return false
+		}
+		err = dropboxErr.GetInner()
+	}
+	return false
+}
+
+// AsError 和errors.As一样，同时展开godropbox的DropboxError
+func AsError(err error, target interface{}) bool {
+	for err != nil {
+		if stderrors.As(err, target) {
+			return true
+		}
+		dropboxErr, ok := err.(errors.DropboxError)
+		if !ok {
+			return false
+		}
+		err = dropboxErr.GetInner()
+	}
+	return false
+}
+
+// isRedisNil key不存在，兼容直接返回redis.Nil的RedisClient实现
+func isRedisNil(err error) bool {
+	return IsError(err, ErrNotFound) || IsError(err, redis.Nil)
+}
+
+// redisError 给RedisClient返回的error加上分类，Error()不变，errors.Is(err, redis.Nil)仍然成立
+func redisError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case err == redis.Nil:
+		return markError(ErrNotFound, err)
+	case isTimeoutError(err):
+		return markError(ErrTimeout, err)
+	case isUnavailableError(err):
+		return markError(ErrUnavailable, err)
+	default:
+		return err
+	}
+}
+
+func isTimeoutError(err error) bool {
+	var netErr net.Error
+	if stderrors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return stderrors.Is(err, stdcontext.DeadlineExceeded)
+}
+
+func isUnavailableError(err error) bool {
+	var opErr *net.OpError
+	switch {
+	case stderrors.Is(err, io.EOF), stderrors.Is(err, io.ErrUnexpectedEOF),
+		stderrors.Is(err, syscall.ECONNREFUSED), stderrors.Is(err, syscall.ECONNRESET), stderrors.Is(err, syscall.EPIPE),
+		stderrors.As(err, &opErr):
+		return true
+	}
+	// go-redis的连接池错误定义在internal包中，只能按内容判断
+	msg := err.Error()
+	return strings.HasPrefix(msg, "redis: connection pool timeout") || msg == "redis: client is closed"
+}
@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"context"
+	stderrors "errors"
+	"net"
+	"testing"
+
+	"github.com/dropbox/godropbox/errors"
+	"github.com/go-redis/redis"
+	goredis "github.com/redis/go-redis/v9"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var _ net.Error = timeoutError{}
+
+func TestErrorTaxonomy(t *testing.T) {
+	notFound := errors.Wrap(EmptyObjectError{"1"}, "get error")
+	if !IsErrorEmpty(notFound) || !IsError(notFound, ErrNotFound) {
+		t.Errorf("wrapped EmptyObjectError should be not found")
+	}
+	if !stderrors.Is(wrapError(notFound, "proxy error"), ErrNotFound) {
+		t.Errorf("errors.Is should see through wrapError")
+	}
+	var emptyErr EmptyObjectError
+	if !stderrors.As(wrapErrorf(notFound, "key %s", "1"), &emptyErr) || emptyErr.Key != "1" {
+		t.Errorf("errors.As should find EmptyObjectError, got %+v", emptyErr)
+	}
+
+	if err := redisError(redis.Nil); !stderrors.Is(err, ErrNotFound) || !stderrors.Is(err, redis.Nil) || err.Error() != redis.Nil.Error() {
+		t.Errorf("redis nil should be not found and keep its message, got %v", err)
+	}
+	if err := goRedisError(goredis.Nil); !stderrors.Is(err, ErrNotFound) || !isRedisNil(err) {
+		t.Errorf("go-redis v9 nil should be not found, got %v", err)
+	}
+	if err := redisError(&net.OpError{Op: "dial", Err: timeoutError{}}); !stderrors.Is(err, ErrTimeout) {
+		t.Errorf("net timeout should be ErrTimeout, got %v", err)
+	}
+	if err := redisError(&net.OpError{Op: "dial", Err: stderrors.New("connection refused")}); !stderrors.Is(err, ErrUnavailable) {
+		t.Errorf("dial error should be ErrUnavailable, got %v", err)
+	}
+
+	if _, err := BuildCacheKey("prefix", String("")); !stderrors.Is(err, ErrInvalidKey) {
+		t.Errorf("empty key should be ErrInvalidKey, got %v", err)
+	}
+}
+
+func TestRedisStorageErrorTaxonomy(t *testing.T) {
+	ctx := context.Background()
+	client := newMockRedisClient()
+	storage := NewRedisStorage(client, "taxonomy", 0, JsonEncoding{}, nil, false)
+
+	var value string
+	if err := storage.Get(ctx, String("1"), &value); !stderrors.Is(err, ErrNotFound) {
+		t.Errorf("missing key should be ErrNotFound, got %v", err)
+	}
+
+	client.values["taxonomy_1"] = "{bad json"
+	err := storage.Get(ctx, String("1"), &value)
+	if !stderrors.Is(err, ErrDecode) || IsErrorEmpty(err) {
+		t.Errorf("undecodable value should be ErrDecode, got %v", err)
+	}
+
+	storage.Checksum = ChecksumCRC32C
+	storage.Set(ctx, String("2"), "a")
+	client.values["taxonomy_2"] = client.values["taxonomy_2"][:len(client.values["taxonomy_2"])-1] + "b"
+	err = storage.Get(ctx, String("2"), &value)
+	if !stderrors.Is(err, ErrDecode) || !IsErrorCorrupt(errors.Wrap(err, "wrapped")) {
+		t.Errorf("checksum mismatch should be a corrupt decode failure, got %v", err)
+	}
+}
@@ -0,0 +1,33 @@
+package storage
+
+import (
+	"context"
+)
+
+// ExistsStorage 由可以不解码value就判断key是否存在的Storage实现
+type ExistsStorage interface {
+	Exists(ctx context.Context, keys ...Key) (map[Key]bool, error)
+}
+
+func redisExists(ctx context.Context, client RedisClient, keyPrefix string, keys []Key) (map[Key]bool, error) {
+	result := make(map[Key]bool, len(keys))
+	if len(keys) == 0 {
+		return result, nil
+	}
+	cacheKeys := make([]string, len(keys))
+	for index, key := range keys {
+		cacheKey, err := BuildCacheKey(keyPrefix, key)
+		if err != nil {
+			return nil, wrapErrorf(err, "build cache key error ,key is %+v", key)
+		}
+		cacheKeys[index] = cacheKey
+	}
+	exists, err := client.Exists(ctx, cacheKeys...)
+	if err != nil {
+		return nil, wrapError(err, "redis exists error")
+	}
+	for i, key := range keys {
+		result[key] = exists[i]
+	}
+	return result, nil
+}
@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestRedisStorageExists(t *testing.T) {
+	ctx := context.Background()
+	_, client := newMiniRedisClient(t)
+	storage := NewRedisStorage(client, "exists", 0, JsonEncoding{}, func() interface{} { return new(string) }, false)
+	storage.Set(ctx, String("1"), "a")
+	storage.Set(ctx, String("3"), "c")
+
+	result, err := storage.Exists(ctx, String("1"), String("2"), String("3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[Key]bool{String("1"): true, String("2"): false, String("3"): true}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("exists should be %v, got %v", expected, result)
+	}
+	if result, err := storage.Exists(ctx); err != nil || len(result) != 0 {
+		t.Errorf("exists without keys should be empty, got %v err=%v", result, err)
+	}
+	if _, err := storage.Exists(ctx, String("")); !IsError(err, ErrInvalidKey) {
+		t.Errorf("invalid key should be ErrInvalidKey, got %v", err)
+	}
+}
+
+func TestStorageProxyExists(t *testing.T) {
+	ctx := context.Background()
+	_, client := newMiniRedisClient(t)
+	prefered := NewRedisStorage(client, "proxy", 0, JsonEncoding{}, func() interface{} { return new(string) }, false)
+	prefered.Set(ctx, String("1"), "a")
+	// key 1只在PreferedStorage中，不能被BackupStorage的结果覆盖
+	backup := &mapStorage{values: map[Key]interface{}{String("2"): "b"}}
+	proxy := NewStorageProxy(prefered, backup)
+
+	result, err := proxy.Exists(ctx, String("1"), String("2"), String("3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[Key]bool{String("1"): true, String("2"): true, String("3"): false}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("exists should fall back to backup for missing keys, expected %v got %v", expected, result)
+	}
+}
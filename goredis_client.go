@@ -0,0 +1,274 @@
+package storage
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis"
+	log "github.com/golang/glog"
+	goredis "github.com/redis/go-redis/v9"
+)
+
+// goRedisClient 基于go-redis v9的RedisClient实现，ctx直接传给每个命令。
+// v9的redis.Nil和旧版不是同一个值，这里统一转换成ErrNotFound
+type goRedisClient struct {
+	client goredis.UniversalClient
+}
+
+// goRedisClusterClient *redis.ClusterClient的multi-key命令中的key必须属于同一个hash slot，
+// 实现ShardedRedisClient后BatchOptions按slot拆分批次
+type goRedisClusterClient struct {
+	goRedisClient
+}
+
+func (r goRedisClusterClient) ShardOf(key string) int {
+	return redisHashSlot(key)
+}
+
+// NewGoRedisClient client可以是*redis.Client或者*redis.ClusterClient，
+// ClusterClient返回的RedisClient实现了ShardedRedisClient。
+// *redis.Ring没有公开key所在的shard，multi-key命令会只发到第一个key的shard，所以不支持。
+// hooks会加到client上(对client的所有使用者生效)，需要和redisClient一样记录耗时时加上RedisLogHook{}。
+// go-redis v8的hook接口不同，需要先升级到v9
+func NewGoRedisClient(client goredis.UniversalClient, hooks ...goredis.Hook) RedisClient {
+	if client == nil {
+		panic("redisclient redis.UniversalClient can NOT be nil")
+	}
+	if _, ok := client.(*goredis.Ring); ok {
+		panic("redisclient *redis.Ring is NOT supported")
+	}
+	for _, hook := range hooks {
+		client.AddHook(hook)
+	}
+	if _, ok := client.(*goredis.ClusterClient); ok {
+		return goRedisClusterClient{goRedisClient{client}}
+	}
+	return goRedisClient{client}
+}
+
+const redisClusterSlots = 16384
+
+// redisHashSlot 返回key在redis cluster中的hash slot，key中有{hashtag}时只计算hashtag
+func redisHashSlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key) % redisClusterSlots)
+}
+
+// crc16 redis cluster使用的CRC16-CCITT(XMODEM)
+func crc16(key string) uint16 {
+	var crc uint16
+	for i := 0; i < len(key); i++ {
+		crc ^= uint16(key[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// goRedisError 和redisError一样给error加上分类
+func goRedisError(err error) error {
+	if err == goredis.Nil {
+		return markError(ErrNotFound, err)
+	}
+	return redisError(err)
+}
+
+func (r goRedisClient) Ping(ctx context.Context) error {
+	return goRedisError(r.client.Ping(ctx).Err())
+}
+
+func (r goRedisClient) Get(ctx context.Context, key string) ([]byte, error) {
+	data, err := r.client.Get(ctx, key).Bytes()
+	if err != nil {
+		return nil, goRedisError(err)
+	}
+	return data, nil
+}
+
+func (r goRedisClient) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) error {
+	return goRedisError(r.client.Set(ctx, key, value, expiration).Err())
+}
+
+func (r goRedisClient) MGet(ctx context.Context, keys ...string) ([]interface{}, error) {
+	values, err := r.client.MGet(ctx, keys...).Result()
+	return values, goRedisError(err)
+}
+
+// MSet MSET和每个key的EXPIRE在同一个pipeline里发出
+func (r goRedisClient) MSet(ctx context.Context, expiration time.Duration, pairs ...interface{}) error {
+	if expiration <= 0 {
+		return goRedisError(r.client.MSet(ctx, pairs...).Err())
+	}
+	_, err := r.client.Pipelined(ctx, func(pipe goredis.Pipeliner) error {
+		pipe.MSet(ctx, pairs...)
+		for i := 0; i < len(pairs); i = i + 2 {
+			pipe.Expire(ctx, pairKeyString(pairs[i]), expiration)
+		}
+		return nil
+	})
+	return goRedisError(err)
+}
+
+func (r goRedisClient) Expire(ctx context.Context, key string, expiration time.Duration) (bool, error) {
+	ok, err := r.client.Expire(ctx, key, expiration).Result()
+	return ok, goRedisError(err)
+}
+
+// TTL 返回key剩余的过期时间，key不存在返回-2，没有过期时间返回-1(和redis的TTL一致)
+func (r goRedisClient) TTL(ctx context.Context, key string) (time.Duration, error) {
+	ttl, err := r.client.PTTL(ctx, key).Result()
+	return ttl, goRedisError(err)
+}
+
+func (r goRedisClient) GetExpire(ctx context.Context, key string, expiration time.Duration) ([]byte, error) {
+	var getCmd *goredis.StringCmd
+	_, err := r.client.Pipelined(ctx, func(pipe goredis.Pipeliner) error {
+		getCmd = pipe.Get(ctx, key)
+		pipe.Expire(ctx, key, expiration)
+		return nil
+	})
+	if err != nil && err != goredis.Nil {
+		return nil, goRedisError(err)
+	}
+	data, err := getCmd.Bytes()
+	if err != nil {
+		return nil, goRedisError(err)
+	}
+	return data, nil
+}
+
+func (r goRedisClient) MGetExpire(ctx context.Context, expiration time.Duration, keys ...string) ([]interface{}, error) {
+	var mgetCmd *goredis.SliceCmd
+	_, err := r.client.Pipelined(ctx, func(pipe goredis.Pipeliner) error {
+		mgetCmd = pipe.MGet(ctx, keys...)
+		for _, key := range keys {
+			pipe.Expire(ctx, key, expiration)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, goRedisError(err)
+	}
+	return mgetCmd.Val(), nil
+}
+
+func (r goRedisClient) Del(ctx context.Context, keys ...string) (int64, error) {
+	n, err := r.client.Del(ctx, keys...).Result()
+	return n, goRedisError(err)
+}
+
+func (r goRedisClient) Exists(ctx context.Context, keys ...string) ([]bool, error) {
+	// EXISTS多个key时只返回存在的个数，所以每个key单独发一个EXISTS
+	cmds := make([]*goredis.IntCmd, len(keys))
+	_, err := r.client.Pipelined(ctx, func(pipe goredis.Pipeliner) error {
+		for i, key := range keys {
+			cmds[i] = pipe.Exists(ctx, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, goRedisError(err)
+	}
+	exists := make([]bool, len(keys))
+	for i, cmd := range cmds {
+		exists[i] = cmd.Val() > 0
+	}
+	return exists, nil
+}
+
+func (r goRedisClient) Incr(ctx context.Context, key string, step int64) (int64, error) {
+	n, err := r.client.IncrBy(ctx, key, step).Result()
+	return n, goRedisError(err)
+}
+
+func (r goRedisClient) Decr(ctx context.Context, key string, step int64) (int64, error) {
+	n, err := r.client.DecrBy(ctx, key, step).Result()
+	return n, goRedisError(err)
+}
+
+func (r goRedisClient) ZrangeByScore(ctx context.Context, key string, max, min string, count int) ([]string, error) {
+	values, err := r.client.ZRangeByScore(ctx, key, &goredis.ZRangeBy{
+		Max:   max,
+		Min:   min,
+		Count: int64(count),
+	}).Result()
+	return values, goRedisError(err)
+}
+
+func (r goRedisClient) ZrevRangeByScore(ctx context.Context, key string, max, min string, count int) ([]string, error) {
+	values, err := r.client.ZRevRangeByScore(ctx, key, &goredis.ZRangeBy{
+		Max:   max,
+		Min:   min,
+		Count: int64(count),
+	}).Result()
+	return values, goRedisError(err)
+}
+
+func (r goRedisClient) ZAdd(ctx context.Context, key string, score float64, value interface{}) error {
+	return goRedisError(r.client.ZAdd(ctx, key, goredis.Z{Score: score, Member: value}).Err())
+}
+
+// ZAddM RedisClient接口使用旧版的redis.Z，这里转换成v9的类型
+func (r goRedisClient) ZAddM(ctx context.Context, key string, members ...redis.Z) error {
+	zs := make([]goredis.Z, len(members))
+	for i, member := range members {
+		zs[i] = goredis.Z{Score: member.Score, Member: member.Member}
+	}
+	return goRedisError(r.client.ZAdd(ctx, key, zs...).Err())
+}
+
+func (r goRedisClient) ZRem(ctx context.Context, key string, value interface{}) error {
+	return goRedisError(r.client.ZRem(ctx, key, value).Err())
+}
+
+func (r goRedisClient) ZCount(ctx context.Context, key, max, min string) (int, error) {
+	count, err := r.client.ZCount(ctx, key, min, max).Result()
+	return int(count), goRedisError(err)
+}
+
+func (r goRedisClient) Scan(ctx context.Context, cursor uint64, match string, count int64) ([]string, uint64, error) {
+	keys, nextCursor, err := r.client.Scan(ctx, cursor, match, count).Result()
+	return keys, nextCursor, goRedisError(err)
+}
+
+// RedisLogHook 和redisClient一样在SetLogFlag打开时记录每个命令和pipeline的耗时
+type RedisLogHook struct{}
+
+func (this RedisLogHook) DialHook(next goredis.DialHook) goredis.DialHook {
+	return next
+}
+
+func (this RedisLogHook) ProcessHook(next goredis.ProcessHook) goredis.ProcessHook {
+	return func(ctx context.Context, cmd goredis.Cmder) error {
+		if atomic.LoadInt32(&logFlag) == 0 {
+			return next(ctx, cmd)
+		}
+		startTime := time.Now()
+		err := next(ctx, cmd)
+		log.Infof("raw_client_%s %d use %d microsecond", cmd.Name(), len(cmd.Args())-1, time.Now().Sub(startTime)/time.Microsecond)
+		return err
+	}
+}
+
+func (this RedisLogHook) ProcessPipelineHook(next goredis.ProcessPipelineHook) goredis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []goredis.Cmder) error {
+		if atomic.LoadInt32(&logFlag) == 0 {
+			return next(ctx, cmds)
+		}
+		startTime := time.Now()
+		err := next(ctx, cmds)
+		log.Infof("raw_client_pipeline %d use %d microsecond", len(cmds), time.Now().Sub(startTime)/time.Microsecond)
+		return err
+	}
+}
@@ -0,0 +1,323 @@
+package storage
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	goredis "github.com/redis/go-redis/v9"
+)
+
+// captureHook 记录经过hook的命令和pipeline
+type captureHook struct {
+	lock      sync.Mutex
+	cmds      []string
+	pipelines [][]string
+}
+
+func (this *captureHook) DialHook(next goredis.DialHook) goredis.DialHook {
+	return next
+}
+
+func (this *captureHook) ProcessHook(next goredis.ProcessHook) goredis.ProcessHook {
+	return func(ctx context.Context, cmd goredis.Cmder) error {
+		this.lock.Lock()
+		this.cmds = append(this.cmds, cmd.Name())
+		this.lock.Unlock()
+		return next(ctx, cmd)
+	}
+}
+
+func (this *captureHook) ProcessPipelineHook(next goredis.ProcessPipelineHook) goredis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []goredis.Cmder) error {
+		names := make([]string, len(cmds))
+		for i, cmd := range cmds {
+			names[i] = cmd.Name()
+		}
+		this.lock.Lock()
+		this.pipelines = append(this.pipelines, names)
+		this.lock.Unlock()
+		return next(ctx, cmds)
+	}
+}
+
+// lastPipeline 返回最后一个pipeline中的命令，并清空记录
+func (this *captureHook) lastPipeline() []string {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if len(this.pipelines) == 0 {
+		return nil
+	}
+	last := this.pipelines[len(this.pipelines)-1]
+	this.cmds, this.pipelines = nil, nil
+	return last
+}
+
+func newMiniGoRedisClient(t *testing.T) (*miniredis.Miniredis, RedisClient, *captureHook) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := goredis.NewClient(&goredis.Options{Addr: server.Addr()})
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	hook := &captureHook{}
+	return server, NewGoRedisClient(client, RedisLogHook{}, hook), hook
+}
+
+func TestGoRedisClientGetExpire(t *testing.T) {
+	ctx := context.Background()
+	server, client, hook := newMiniGoRedisClient(t)
+	server.Set("a", "1")
+
+	data, err := client.GetExpire(ctx, "a", time.Minute)
+	if err != nil || string(data) != "1" {
+		t.Errorf("get expire data=%q err=%v", data, err)
+	}
+	if ttl := server.TTL("a"); ttl != time.Minute {
+		t.Errorf("get expire should set ttl, got %v", ttl)
+	}
+	if cmds := hook.lastPipeline(); len(cmds) != 2 || cmds[0] != "get" || cmds[1] != "expire" {
+		t.Errorf("get expire should pipeline GET and EXPIRE, got %v", cmds)
+	}
+
+	data, err = client.GetExpire(ctx, "missing", time.Minute)
+	if !IsError(err, ErrNotFound) || data != nil {
+		t.Errorf("missing key should be not found with nil data, data=%v err=%v", data, err)
+	}
+	if data, err = client.Get(ctx, "missing"); !IsError(err, ErrNotFound) || data != nil {
+		t.Errorf("missing key should be not found with nil data, data=%v err=%v", data, err)
+	}
+	if server.Exists("missing") {
+		t.Error("get expire should not create missing key")
+	}
+}
+
+func TestGoRedisClientMGetExpire(t *testing.T) {
+	ctx := context.Background()
+	server, client, hook := newMiniGoRedisClient(t)
+	server.Set("a", "1")
+	server.Set("c", "3")
+
+	values, err := client.MGetExpire(ctx, time.Minute, "a", "b", "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 3 || values[0] != "1" || values[1] != nil || values[2] != "3" {
+		t.Errorf("mget expire values mismatch %v", values)
+	}
+	for _, key := range []string{"a", "c"} {
+		if ttl := server.TTL(key); ttl != time.Minute {
+			t.Errorf("mget expire should set ttl of %s, got %v", key, ttl)
+		}
+	}
+	if cmds := hook.lastPipeline(); len(cmds) != 4 || cmds[0] != "mget" {
+		t.Errorf("mget expire should pipeline MGET and one EXPIRE per key, got %v", cmds)
+	}
+}
+
+func TestGoRedisClientMSet(t *testing.T) {
+	ctx := context.Background()
+	server, client, hook := newMiniGoRedisClient(t)
+
+	if err := client.MSet(ctx, time.Minute, "a", []byte("1"), "b", "2"); err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range map[string]string{"a": "1", "b": "2"} {
+		if got, _ := server.Get(key); got != value {
+			t.Errorf("mset %s should be %s, got %s", key, value, got)
+		}
+		if ttl := server.TTL(key); ttl != time.Minute {
+			t.Errorf("mset should expire %s, got ttl %v", key, ttl)
+		}
+	}
+	if cmds := hook.lastPipeline(); len(cmds) != 3 || cmds[0] != "mset" || cmds[1] != "expire" || cmds[2] != "expire" {
+		t.Errorf("mset should pipeline MSET and one EXPIRE per key, got %v", cmds)
+	}
+
+	// 没有过期时间时不发EXPIRE
+	if err := client.MSet(ctx, 0, "c", "3"); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := server.TTL("c"); ttl != 0 {
+		t.Errorf("mset without expiration should not set ttl, got %v", ttl)
+	}
+	if cmds := hook.lastPipeline(); cmds != nil {
+		t.Errorf("mset without expiration should not use pipeline, got %v", cmds)
+	}
+}
+
+func TestGoRedisClientExists(t *testing.T) {
+	ctx := context.Background()
+	server, client, _ := newMiniGoRedisClient(t)
+	server.Set("a", "1")
+	server.Set("c", "3")
+
+	exists, err := client.Exists(ctx, "a", "b", "c", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []bool{true, false, true, true}
+	if len(exists) != len(expected) {
+		t.Fatalf("exists should be aligned with keys, got %v", exists)
+	}
+	for i := range expected {
+		if exists[i] != expected[i] {
+			t.Errorf("exists expected %v, got %v", expected, exists)
+			break
+		}
+	}
+}
+
+func TestGoRedisClientLogHook(t *testing.T) {
+	ctx := context.Background()
+	_, client, hook := newMiniGoRedisClient(t)
+	defer SetLogFlag(1)
+	for _, flag := range []int32{0, 1} {
+		SetLogFlag(flag)
+		if err := client.Set(ctx, "a", "1", 0); err != nil {
+			t.Fatal(err)
+		}
+		if data, err := client.Get(ctx, "a"); err != nil || string(data) != "1" {
+			t.Errorf("log flag %d: get through hooks data=%q err=%v", flag, data, err)
+		}
+		if _, err := client.GetExpire(ctx, "a", time.Minute); err != nil {
+			t.Errorf("log flag %d: pipeline through hooks err=%v", flag, err)
+		}
+	}
+	hook.lock.Lock()
+	defer hook.lock.Unlock()
+	if len(hook.cmds) != 4 || len(hook.pipelines) != 2 {
+		t.Errorf("commands should pass through RedisLogHook to the next hook, cmds=%v pipelines=%v", hook.cmds, hook.pipelines)
+	}
+}
+
+func TestRedisHashSlot(t *testing.T) {
+	for key, slot := range map[string]int{
+		"123456789":            0x31c3,
+		"foo":                  12182,
+		"bar":                  5061,
+		"{user1000}.following": redisHashSlot("user1000"),
+		"{user1000}.followers": redisHashSlot("user1000"),
+		"foo{}{bar}":           int(crc16("foo{}{bar}") % redisClusterSlots),
+		"foo{{bar}}zap":        redisHashSlot("{bar"),
+		"foo{bar}{zap}":        redisHashSlot("bar"),
+	} {
+		if got := redisHashSlot(key); got != slot {
+			t.Errorf("slot of %s should be %d, got %d", key, slot, got)
+		}
+	}
+}
+
+// 每个multi-key命令中的key都要属于同一个slot，否则cluster返回CROSSSLOT
+func TestGoRedisClusterClient(t *testing.T) {
+	ctx := context.Background()
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	cluster := goredis.NewClusterClient(&goredis.ClusterOptions{Addrs: []string{server.Addr()}})
+	defer cluster.Close()
+	var lock sync.Mutex
+	var crossSlot []string
+	client := NewGoRedisClient(cluster, slotCheckHook{func(cmd goredis.Cmder) {
+		args := cmd.Args()
+		var keys []string
+		switch cmd.Name() {
+		case "mget", "del":
+			for _, arg := range args[1:] {
+				keys = append(keys, arg.(string))
+			}
+		case "mset":
+			for i := 1; i < len(args); i += 2 {
+				keys = append(keys, pairKeyString(args[i]))
+			}
+		}
+		for _, key := range keys {
+			if redisHashSlot(key) != redisHashSlot(keys[0]) {
+				lock.Lock()
+				crossSlot = append(crossSlot, cmd.String())
+				lock.Unlock()
+				return
+			}
+		}
+	}})
+	if _, ok := client.(ShardedRedisClient); !ok {
+		t.Fatal("cluster client should implement ShardedRedisClient")
+	}
+
+	storage := NewRedisStorage(client, "cluster", time.Minute, JsonEncoding{}, func() interface{} { return new(string) }, false)
+	storage.ChunkSize = 8
+	values := map[Key]interface{}{}
+	keys := make([]Key, 20)
+	for i := range keys {
+		keys[i] = Int(i)
+		values[keys[i]] = strconv.Itoa(i)
+	}
+	values[Int(0)] = strings.Repeat("chunked ", 4)
+	if err := storage.MultiSet(ctx, values); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Set(ctx, Int(0), strings.Repeat("chunked ", 4)); err != nil {
+		t.Fatal(err)
+	}
+	result := make(map[Key]*string)
+	if err := storage.MultiGet(ctx, keys, result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != len(keys) || *result[Int(0)] != values[Int(0)] || *result[Int(19)] != "19" {
+		t.Errorf("cluster MultiGet mismatch, got %d values", len(result))
+	}
+	if err := storage.Delete(ctx, keys...); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.SampleValues(ctx, 10); err != nil {
+		t.Fatal(err)
+	}
+	if len(crossSlot) != 0 {
+		t.Errorf("multi-key commands should not cross slots, got %v", crossSlot)
+	}
+}
+
+// slotCheckHook 对每个命令(包括pipeline中的)调用check
+type slotCheckHook struct {
+	check func(cmd goredis.Cmder)
+}
+
+func (this slotCheckHook) DialHook(next goredis.DialHook) goredis.DialHook {
+	return next
+}
+
+func (this slotCheckHook) ProcessHook(next goredis.ProcessHook) goredis.ProcessHook {
+	return func(ctx context.Context, cmd goredis.Cmder) error {
+		this.check(cmd)
+		return next(ctx, cmd)
+	}
+}
+
+func (this slotCheckHook) ProcessPipelineHook(next goredis.ProcessPipelineHook) goredis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []goredis.Cmder) error {
+		for _, cmd := range cmds {
+			this.check(cmd)
+		}
+		return next(ctx, cmds)
+	}
+}
+
+func TestGoRedisClientRing(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("ring client should not be supported")
+		}
+	}()
+	ring := goredis.NewRing(&goredis.RingOptions{Addrs: map[string]string{"a": "127.0.0.1:0"}})
+	defer ring.Close()
+	NewGoRedisClient(ring)
+}
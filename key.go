@@ -40,17 +40,34 @@ func (this EmptyObjectError) Error() string {
 	return fmt.Sprintf("key %s does not exists", this.Key)
 }
 
-func IsErrorEmpty(err error) bool {
-	if err == nil {
-		return false
-	}
+func (this EmptyObjectError) Is(target error) bool {
+	return target == ErrNotFound
+}
 
-	switch err.(type) {
-	case EmptyObjectError:
-		return true
-	default:
-		return false
-	}
+// CorruptValueError 表示value的envelope不合法或者checksum不一致，
+// StorageProxy会把它当作miss处理并用BackupStorage中的数据覆盖
+type CorruptValueError struct {
+	Key    string
+	Reason string
+}
+
+func (this CorruptValueError) Error() string {
+	return fmt.Sprintf("key %s value is corrupt: %s", this.Key, this.Reason)
+}
+
+func (this CorruptValueError) Is(target error) bool {
+	return target == ErrDecode
+}
+
+// IsErrorCorrupt err链中有CorruptValueError
+func IsErrorCorrupt(err error) bool {
+	var corruptErr CorruptValueError
+	return AsError(err, &corruptErr)
+}
+
+// IsErrorEmpty key不存在，err链中有EmptyObjectError或者ErrNotFound
+func IsErrorEmpty(err error) bool {
+	return IsError(err, ErrNotFound)
 }
 
 func IntList2KeyList(intList []int) (keyList []Key) {
@@ -103,7 +120,7 @@ func KeyList2StringList(keyList []Key) (stringList []string) {
 
 func BuildCacheKey(keyPrefix string, key Key) (cacheKey string, err error) {
 	if key == nil || key.String() == "" {
-		return "", errors.New("key should not be nil or to string should not be empty string")
+		return "", markError(ErrInvalidKey, errors.New("key should not be nil or to string should not be empty string"))
 	}
 	cacheKey, err = strings.Join([]string{keyPrefix, key.String()}, "_"), nil
 	// log.Info("redis_cache_key ", cacheKey)
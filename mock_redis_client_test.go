@@ -0,0 +1,219 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis"
+)
+
+// mockRedisClient 内存版的RedisClient，只实现了string相关的命令，过期时间只记录不生效，
+// Get/MGet在ctx结束后返回ctx.Err()
+type mockRedisClient struct {
+	lock    sync.Mutex
+	values  map[string]string
+	expires map[string]time.Duration
+}
+
+var errMockUnsupported = errors.New("mock redis client unsupported command")
+
+func newMockRedisClient() *mockRedisClient {
+	return &mockRedisClient{
+		values:  make(map[string]string),
+		expires: make(map[string]time.Duration),
+	}
+}
+
+func mockString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case BytesValue:
+		return string(v)
+	default:
+		panic("mock redis client unsupported value type")
+	}
+}
+
+func (this *mockRedisClient) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (this *mockRedisClient) Get(ctx context.Context, key string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	value, ok := this.values[key]
+	if !ok {
+		return nil, redis.Nil
+	}
+	return []byte(value), nil
+}
+
+func (this *mockRedisClient) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.values[key] = mockString(value)
+	this.expires[key] = expiration
+	return nil
+}
+
+func (this *mockRedisClient) MGet(ctx context.Context, keys ...string) ([]interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	result := make([]interface{}, len(keys))
+	for i, key := range keys {
+		if value, ok := this.values[key]; ok {
+			result[i] = value
+		}
+	}
+	return result, nil
+}
+
+func (this *mockRedisClient) MSet(ctx context.Context, expiration time.Duration, pairs ...interface{}) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	for i := 0; i+1 < len(pairs); i += 2 {
+		key := mockString(pairs[i])
+		this.values[key] = mockString(pairs[i+1])
+		this.expires[key] = expiration
+	}
+	return nil
+}
+
+func (this *mockRedisClient) Expire(ctx context.Context, key string, expiration time.Duration) (bool, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if _, ok := this.values[key]; !ok {
+		return false, nil
+	}
+	this.expires[key] = expiration
+	return true, nil
+}
+
+func (this *mockRedisClient) TTL(ctx context.Context, key string) (time.Duration, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if _, ok := this.values[key]; !ok {
+		return -2, nil
+	}
+	if this.expires[key] <= 0 {
+		return -1, nil
+	}
+	return this.expires[key], nil
+}
+
+func (this *mockRedisClient) GetExpire(ctx context.Context, key string, expiration time.Duration) ([]byte, error) {
+	this.Expire(ctx, key, expiration)
+	return this.Get(ctx, key)
+}
+
+func (this *mockRedisClient) MGetExpire(ctx context.Context, expiration time.Duration, keys ...string) ([]interface{}, error) {
+	for _, key := range keys {
+		this.Expire(ctx, key, expiration)
+	}
+	return this.MGet(ctx, keys...)
+}
+
+func (this *mockRedisClient) Del(ctx context.Context, keys ...string) (int64, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	var count int64
+	for _, key := range keys {
+		if _, ok := this.values[key]; ok {
+			count++
+		}
+		delete(this.values, key)
+		delete(this.expires, key)
+	}
+	return count, nil
+}
+
+func (this *mockRedisClient) Exists(ctx context.Context, keys ...string) ([]bool, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	result := make([]bool, len(keys))
+	for i, key := range keys {
+		_, result[i] = this.values[key]
+	}
+	return result, nil
+}
+
+func (this *mockRedisClient) Incr(ctx context.Context, key string, step int64) (int64, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	value, _ := strconv.ParseInt(this.values[key], 10, 64)
+	value += step
+	this.values[key] = strconv.FormatInt(value, 10)
+	return value, nil
+}
+
+func (this *mockRedisClient) Decr(ctx context.Context, key string, step int64) (int64, error) {
+	return this.Incr(ctx, key, -step)
+}
+
+func (this *mockRedisClient) ZrangeByScore(ctx context.Context, key string, max, min string, count int) ([]string, error) {
+	return nil, errMockUnsupported
+}
+
+func (this *mockRedisClient) ZrevRangeByScore(ctx context.Context, key string, max, min string, count int) ([]string, error) {
+	return nil, errMockUnsupported
+}
+
+func (this *mockRedisClient) ZAdd(ctx context.Context, key string, score float64, value interface{}) error {
+	return errMockUnsupported
+}
+
+func (this *mockRedisClient) ZRem(ctx context.Context, key string, value interface{}) error {
+	return errMockUnsupported
+}
+
+func (this *mockRedisClient) ZCount(ctx context.Context, key, max, min string) (int, error) {
+	return 0, errMockUnsupported
+}
+
+func (this *mockRedisClient) ZAddM(ctx context.Context, key string, members ...redis.Z) error {
+	return errMockUnsupported
+}
+
+// Scan 一次返回所有匹配的key
+func (this *mockRedisClient) Scan(ctx context.Context, cursor uint64, match string, count int64) ([]string, uint64, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	var keys []string
+	for key := range this.values {
+		if ok, _ := path.Match(match, key); ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, 0, nil
+}
+
+// newMiniRedisClient 基于进程内redis server的RedisClient，用来测试依赖go-redis真实返回值的逻辑
+func newMiniRedisClient(t *testing.T) (*miniredis.Miniredis, RedisClient) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return server, NewRedisClient(client)
+}
@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+
+	"github.com/dropbox/godropbox/errors"
+)
+
+// canonicalMsgpack 把msgpack数据中所有map的entry按编码后的key排序，其它内容不变。
+// msgpack的SortMapKeys只对map[string]string和map[string]interface{}生效，
+// 其它类型的map(比如map[string]int64、map[int]string)仍然是随机顺序
+func canonicalMsgpack(data []byte) ([]byte, error) {
+	out, rest, err := appendCanonicalMsgpack(make([]byte, 0, len(data)), data)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, errors.Newf("msgpack data has %d trailing bytes", len(rest))
+	}
+	return out, nil
+}
+
+var errMsgpackTruncated = errors.New("msgpack data truncated")
+
+const (
+	msgpackScalar byte = iota
+	msgpackArray
+	msgpackMap
+)
+
+// msgpackHeader 解析一个值的header，返回header长度、之后的数据长度(map/array时是元素个数)
+func msgpackHeader(data []byte) (headerSize int, size uint64, kind byte, err error) {
+	if len(data) == 0 {
+		return 0, 0, 0, errMsgpackTruncated
+	}
+	c := data[0]
+	length := func(n int) (uint64, error) {
+		if len(data) < 1+n {
+			return 0, errMsgpackTruncated
+		}
+		switch n {
+		case 1:
+			return uint64(data[1]), nil
+		case 2:
+			return uint64(binary.BigEndian.Uint16(data[1:])), nil
+		default:
+			return uint64(binary.BigEndian.Uint32(data[1:])), nil
+		}
+	}
+	switch {
+	case c <= 0x7f || c >= 0xe0 || c == 0xc0 || c == 0xc2 || c == 0xc3:
+		return 1, 0, msgpackScalar, nil
+	case c >= 0x80 && c <= 0x8f:
+		return 1, uint64(c & 0x0f), msgpackMap, nil
+	case c >= 0x90 && c <= 0x9f:
+		return 1, uint64(c & 0x0f), msgpackArray, nil
+	case c >= 0xa0 && c <= 0xbf:
+		return 1, uint64(c & 0x1f), msgpackScalar, nil
+	}
+	switch c {
+	case 0xc4, 0xd9: // bin8, str8
+		size, err = length(1)
+		return 2, size, msgpackScalar, err
+	case 0xc5, 0xda: // bin16, str16
+		size, err = length(2)
+		return 3, size, msgpackScalar, err
+	case 0xc6, 0xdb: // bin32, str32
+		size, err = length(4)
+		return 5, size, msgpackScalar, err
+	case 0xc7: // ext8
+		size, err = length(1)
+		return 3, size, msgpackScalar, err
+	case 0xc8: // ext16
+		size, err = length(2)
+		return 4, size, msgpackScalar, err
+	case 0xc9: // ext32
+		size, err = length(4)
+		return 6, size, msgpackScalar, err
+	case 0xcc, 0xd0: // uint8, int8
+		return 1, 1, msgpackScalar, nil
+	case 0xcd, 0xd1: // uint16, int16
+		return 1, 2, msgpackScalar, nil
+	case 0xca, 0xce, 0xd2: // float32, uint32, int32
+		return 1, 4, msgpackScalar, nil
+	case 0xcb, 0xcf, 0xd3: // float64, uint64, int64
+		return 1, 8, msgpackScalar, nil
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8: // fixext 1/2/4/8/16
+		return 2, 1 << (c - 0xd4), msgpackScalar, nil
+	case 0xdc: // array16
+		size, err = length(2)
+		return 3, size, msgpackArray, err
+	case 0xdd: // array32
+		size, err = length(4)
+		return 5, size, msgpackArray, err
+	case 0xde: // map16
+		size, err = length(2)
+		return 3, size, msgpackMap, err
+	case 0xdf: // map32
+		size, err = length(4)
+		return 5, size, msgpackMap, err
+	}
+	return 0, 0, 0, errors.Newf("invalid msgpack code 0x%x", c)
+}
+
+type msgpackEntry struct {
+	key   []byte
+	value []byte
+}
+
+// appendCanonicalMsgpack 把data中的第一个值排序后追加到out，返回剩余的数据
+func appendCanonicalMsgpack(out, data []byte) ([]byte, []byte, error) {
+	headerSize, size, kind, err := msgpackHeader(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if uint64(len(data)) < uint64(headerSize) {
+		return nil, nil, errMsgpackTruncated
+	}
+	out = append(out, data[:headerSize]...)
+	data = data[headerSize:]
+	switch kind {
+	case msgpackScalar:
+		if uint64(len(data)) < size {
+			return nil, nil, errMsgpackTruncated
+		}
+		return append(out, data[:size]...), data[size:], nil
+	case msgpackArray:
+		for i := uint64(0); i < size; i++ {
+			if out, data, err = appendCanonicalMsgpack(out, data); err != nil {
+				return nil, nil, err
+			}
+		}
+		return out, data, nil
+	}
+
+	// 每个entry至少2个字节，避免损坏的数据分配过大的空间
+	if size > uint64(len(data))/2 {
+		return nil, nil, errMsgpackTruncated
+	}
+	entries := make([]msgpackEntry, size)
+	for i := range entries {
+		if entries[i].key, data, err = appendCanonicalMsgpack(nil, data); err != nil {
+			return nil, nil, err
+		}
+		if entries[i].value, data, err = appendCanonicalMsgpack(nil, data); err != nil {
+			return nil, nil, err
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].key, entries[j].key) < 0
+	})
+	for _, entry := range entries {
+		out = append(out, entry.key...)
+		out = append(out, entry.value...)
+	}
+	return out, data, nil
+}
@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"fmt"
+)
+
+// ErrorStage multi-key操作中一个key出错的阶段
+type ErrorStage string
+
+const (
+	StageBuildKey ErrorStage = "build_key"
+	StageEncode   ErrorStage = "encode"
+	StageDecode   ErrorStage = "decode"
+	StageRedis    ErrorStage = "redis"
+	StageBackup   ErrorStage = "backup"
+)
+
+// KeyError 是multi-key操作中一个key的失败
+type KeyError struct {
+	Key   Key
+	Stage ErrorStage
+	Err   error
+}
+
+func (this KeyError) Error() string {
+	return fmt.Sprintf("key %v %s error: %v", this.Key, this.Stage, this.Err)
+}
+
+func (this KeyError) Unwrap() error {
+	return this.Err
+}
+
+// Is build key和decode阶段的失败分别对应ErrInvalidKey和ErrDecode
+func (this KeyError) Is(target error) bool {
+	switch this.Stage {
+	case StageBuildKey:
+		return target == ErrInvalidKey
+	case StageDecode:
+		return target == ErrDecode
+	default:
+		return false
+	}
+}
+
+// MultiError multi-key操作中部分key失败时返回，没有列出的key都已经成功。
+// BatchOptions.FailFast为true时遇到第一个失败就返回，这时后面的key没有执行
+type MultiError struct {
+	Errors []KeyError
+}
+
+func (this *MultiError) Error() string {
+	if len(this.Errors) == 1 {
+		return this.Errors[0].Error()
+	}
+	return fmt.Sprintf("%d keys failed, first error: %v", len(this.Errors), this.Errors[0])
+}
+
+func (this *MultiError) Add(key Key, stage ErrorStage, err error) {
+	this.Errors = append(this.Errors, KeyError{Key: key, Stage: stage, Err: err})
+}
+
+// addAll 把和keys一一对应的keyErrs中不为nil的加入
+func (this *MultiError) addAll(keys []Key, stage ErrorStage, keyErrs []error) {
+	for i, err := range keyErrs {
+		if err != nil {
+			this.Add(keys[i], stage, err)
+		}
+	}
+}
+
+// Keys 返回失败的key
+func (this *MultiError) Keys() []Key {
+	keys := make([]Key, len(this.Errors))
+	for i, keyErr := range this.Errors {
+		keys[i] = keyErr.Key
+	}
+	return keys
+}
+
+// Unwrap errors.Is/As对任意一个失败的key成立时对MultiError成立
+func (this *MultiError) Unwrap() []error {
+	errs := make([]error, len(this.Errors))
+	for i, keyErr := range this.Errors {
+		errs[i] = keyErr
+	}
+	return errs
+}
+
+// ErrorOrNil 没有失败的key时返回nil，避免返回值为nil的*MultiError
+func (this *MultiError) ErrorOrNil() error {
+	if this == nil || len(this.Errors) == 0 {
+		return nil
+	}
+	return this
+}
@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// mapStorage 内存版的Storage，用作StorageProxy的BackupStorage
+type mapStorage struct {
+	values map[Key]interface{}
+}
+
+func (this *mapStorage) Get(ctx context.Context, key Key, value interface{}) error {
+	if _, ok := this.values[key]; !ok {
+		return EmptyObjectError{key.String()}
+	}
+	return nil
+}
+
+func (this *mapStorage) Set(ctx context.Context, key Key, object interface{}) error {
+	this.values[key] = object
+	return nil
+}
+
+func (this *mapStorage) Add(ctx context.Context, key Key, object interface{}) error {
+	return this.Set(ctx, key, object)
+}
+
+func (this *mapStorage) MultiGet(ctx context.Context, keys []Key, valuesMap interface{}) error {
+	values := valuesMap.(map[Key]interface{})
+	for _, key := range keys {
+		if value, ok := this.values[key]; ok {
+			values[key] = value
+		}
+	}
+	return nil
+}
+
+func (this *mapStorage) MultiSet(ctx context.Context, values map[Key]interface{}) error {
+	for key, value := range values {
+		this.values[key] = value
+	}
+	return nil
+}
+
+func (this *mapStorage) Delete(ctx context.Context, keys ...Key) error {
+	for _, key := range keys {
+		delete(this.values, key)
+	}
+	return nil
+}
+
+func (this *mapStorage) Exists(ctx context.Context, keys ...Key) (map[Key]bool, error) {
+	result := make(map[Key]bool, len(keys))
+	for _, key := range keys {
+		_, result[key] = this.values[key]
+	}
+	return result, nil
+}
+
+func TestRedisStorageMultiError(t *testing.T) {
+	ctx := context.Background()
+	client := newMockRedisClient()
+	storage := NewRedisStorage(client, "multierr", 0, Int64Encoding{}, func() interface{} { return new(int64) }, false)
+
+	err := storage.MultiSet(ctx, map[Key]interface{}{String("1"): int64(1), String("2"): "not int64", String(""): int64(3)})
+	multiErr, ok := err.(*MultiError)
+	if !ok || len(multiErr.Errors) != 2 {
+		t.Fatalf("expected 2 failed keys, got %v", err)
+	}
+	stages := map[ErrorStage]bool{}
+	for _, keyErr := range multiErr.Errors {
+		stages[keyErr.Stage] = true
+	}
+	if !stages[StageEncode] || !stages[StageBuildKey] {
+		t.Errorf("expected encode and build key failures, got %v", multiErr.Errors)
+	}
+	if len(client.values) != 1 {
+		t.Errorf("valid key should still be written, got %d keys", len(client.values))
+	}
+
+	storage.Batch.FailFast = true
+	err = storage.MultiSet(ctx, map[Key]interface{}{String("3"): "not int64"})
+	if multiErr, ok := err.(*MultiError); !ok || len(multiErr.Errors) != 1 {
+		t.Errorf("fail fast should return the first failure, got %v", err)
+	}
+}
+
+func TestStorageProxyMultiGetHealsMultiError(t *testing.T) {
+	ctx := context.Background()
+	client := newMockRedisClient()
+	prefered := NewRedisStorage(client, "proxy", 0, JsonEncoding{}, func() interface{} { return new(string) }, false)
+	prefered.Set(ctx, String("1"), "a")
+	client.values["proxy_2"] = "{bad json"
+	backup := &mapStorage{values: map[Key]interface{}{String("2"): "b"}}
+	proxy := NewStorageProxy(prefered, backup)
+
+	values := make(map[Key]interface{})
+	err := proxy.MultiGet(ctx, []Key{String("1"), String("2"), String("3")}, values)
+	if err != nil {
+		t.Fatalf("corrupt key healed from backup should not be reported, got %v", err)
+	}
+	if len(values) != 2 || values[String("2")] != "b" {
+		t.Errorf("values mismatch %v", values)
+	}
+
+	client.values["proxy_3"] = "{bad json"
+	values = make(map[Key]interface{})
+	err = proxy.MultiGet(ctx, []Key{String("3")}, values)
+	if multiErr, ok := err.(*MultiError); !ok || multiErr.Errors[0].Stage != StageDecode {
+		t.Errorf("unhealed decode failure should be propagated, got %v", err)
+	}
+}
+
+// partialDeleteStorage Delete时failKey失败，其它key正常删除
+type partialDeleteStorage struct {
+	*mapStorage
+	failKey Key
+}
+
+func (this partialDeleteStorage) Delete(ctx context.Context, keys ...Key) error {
+	multiErr := &MultiError{}
+	for _, key := range keys {
+		if key == this.failKey {
+			multiErr.Add(key, StageRedis, errors.New("delete failed"))
+			continue
+		}
+		delete(this.values, key)
+	}
+	return multiErr.ErrorOrNil()
+}
+
+func TestStorageProxyDeletePartialFailure(t *testing.T) {
+	ctx := context.Background()
+	client := newMockRedisClient()
+	prefered := NewRedisStorage(client, "proxy", 0, JsonEncoding{}, func() interface{} { return new(string) }, false)
+	prefered.MultiSet(ctx, map[Key]interface{}{String("1"): "a", String("2"): "b"})
+	backup := partialDeleteStorage{&mapStorage{values: map[Key]interface{}{String("1"): "a", String("2"): "b"}}, String("2")}
+	proxy := NewStorageProxy(prefered, backup)
+
+	err := proxy.Delete(ctx, String("1"), String("2"))
+	multiErr, ok := err.(*MultiError)
+	if !ok || len(multiErr.Errors) != 1 || multiErr.Errors[0].Key != String("2") || multiErr.Errors[0].Stage != StageBackup {
+		t.Fatalf("backup failure should be returned as MultiError, got %v", err)
+	}
+	// 缓存中的key都要删除，下次读取时从BackupStorage重新加载
+	if len(client.values) != 0 {
+		t.Errorf("prefered storage should be deleted even if backup partially failed, got %v", client.values)
+	}
+	if _, ok := backup.values[String("1")]; ok {
+		t.Error("key 1 should be deleted from backup")
+	}
+}
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"context"
 	"reflect"
 	"sync/atomic"
 	"time"
@@ -13,27 +14,35 @@ import (
 // 方便定义mockredis进行单元测试,
 // 方便实现shard版的RedisClient等
 type RedisClient interface {
-	Get(key string) ([]byte, error)
-	Set(key string, value interface{}, expiration time.Duration) error
-	MGet(keys ...string) ([]interface{}, error)
-	MSet(expiration time.Duration, pairs ...interface{}) error
-	Expire(key string, expiration time.Duration) (bool, error)
-	Del(keys ...string) (int64, error)
-	Incr(key string, step int64) (int64, error)
-	Decr(key string, step int64) (int64, error)
-	ZrangeByScore(key string, max, min string, count int) ([]string, error)
-	ZrevRangeByScore(key string, max, min string, count int) ([]string, error)
-	ZAdd(key string, score float64, value interface{}) error
-	ZRem(key string, value interface{}) error
-	ZCount(key, max, min string) (int, error)
-	ZAddM(key string, members ...redis.Z) error
-	Ping() error
+	Get(ctx context.Context, key string) ([]byte, error)
+	Set(ctx context.Context, key string, value interface{}, expiration time.Duration) error
+	MGet(ctx context.Context, keys ...string) ([]interface{}, error)
+	MSet(ctx context.Context, expiration time.Duration, pairs ...interface{}) error
+	Expire(ctx context.Context, key string, expiration time.Duration) (bool, error)
+	TTL(ctx context.Context, key string) (time.Duration, error)
+	// GetExpire/MGetExpire 在同一个pipeline里读取并刷新过期时间
+	GetExpire(ctx context.Context, key string, expiration time.Duration) ([]byte, error)
+	MGetExpire(ctx context.Context, expiration time.Duration, keys ...string) ([]interface{}, error)
+	Del(ctx context.Context, keys ...string) (int64, error)
+	// Exists 返回每个key是否存在，和keys一一对应
+	Exists(ctx context.Context, keys ...string) ([]bool, error)
+	Incr(ctx context.Context, key string, step int64) (int64, error)
+	Decr(ctx context.Context, key string, step int64) (int64, error)
+	ZrangeByScore(ctx context.Context, key string, max, min string, count int) ([]string, error)
+	ZrevRangeByScore(ctx context.Context, key string, max, min string, count int) ([]string, error)
+	ZAdd(ctx context.Context, key string, score float64, value interface{}) error
+	ZRem(ctx context.Context, key string, value interface{}) error
+	ZCount(ctx context.Context, key, max, min string) (int, error)
+	ZAddM(ctx context.Context, key string, members ...redis.Z) error
+	Scan(ctx context.Context, cursor uint64, match string, count int64) (keys []string, nextCursor uint64, err error)
+	Ping(ctx context.Context) error
 }
 
 type redisClient struct {
 	client *redis.Client
 }
 
+// NewRedisClient ctx只在发出命令前检查，见contextError
 func NewRedisClient(client *redis.Client) (r RedisClient) {
 	return redisClient{client}
 }
@@ -47,11 +56,35 @@ func newRedisClient(client *redis.Client, options *redis.Options) (r RedisClient
 	return
 }
 
-func (r redisClient) Ping() error {
-	return r.client.Ping().Err()
+// contextError 发出命令前检查ctx是否已经结束。
+// go-redis v6只保存ctx，不用它控制读写，已经发出的命令只受Options中ReadTimeout/WriteTimeout的限制，
+// 需要按ctx的deadline中断命令时使用NewGoRedisClient
+func contextError(ctx context.Context) error {
+	if ctx == nil {
+		return nil
+	}
+	return redisError(ctx.Err())
 }
 
-func (r redisClient) Get(key string) ([]byte, error) {
+// withContext 命令带上ctx，见contextError
+func (r redisClient) withContext(ctx context.Context) *redis.Client {
+	if ctx == nil {
+		return r.client
+	}
+	return r.client.WithContext(ctx)
+}
+
+func (r redisClient) Ping(ctx context.Context) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+	return redisError(r.withContext(ctx).Ping().Err())
+}
+
+func (r redisClient) Get(ctx context.Context, key string) ([]byte, error) {
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
 	if atomic.LoadInt32(&logFlag) != 0 {
 		startTime := time.Now()
 		defer func() {
@@ -59,10 +92,18 @@ func (r redisClient) Get(key string) ([]byte, error) {
 
 		}()
 	}
-	return r.client.Get(key).Bytes()
+	data, err := r.withContext(ctx).Get(key).Bytes()
+	if err != nil {
+		// key不存在时go-redis返回的是空slice，调用方用nil判断key不存在
+		return nil, redisError(err)
+	}
+	return data, nil
 }
 
-func (r redisClient) Set(key string, value interface{}, expiration time.Duration) error {
+func (r redisClient) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
 	if atomic.LoadInt32(&logFlag) != 0 {
 		startTime := time.Now()
 		defer func() {
@@ -70,10 +111,13 @@ func (r redisClient) Set(key string, value interface{}, expiration time.Duration
 
 		}()
 	}
-	return r.client.Set(key, value, expiration).Err()
+	return redisError(r.withContext(ctx).Set(key, value, expiration).Err())
 }
 
-func (r redisClient) MGet(keys ...string) ([]interface{}, error) {
+func (r redisClient) MGet(ctx context.Context, keys ...string) ([]interface{}, error) {
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
 	if atomic.LoadInt32(&logFlag) != 0 {
 		startTime := time.Now()
 		defer func() {
@@ -81,28 +125,32 @@ func (r redisClient) MGet(keys ...string) ([]interface{}, error) {
 		}()
 	}
 
-	value, err := r.client.MGet(keys...).Result()
-	return value, err
+	value, err := r.withContext(ctx).MGet(keys...).Result()
+	return value, redisError(err)
 }
 
-func (r redisClient) MSet(expiration time.Duration, pairs ...interface{}) error {
+func (r redisClient) MSet(ctx context.Context, expiration time.Duration, pairs ...interface{}) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
 	if atomic.LoadInt32(&logFlag) != 0 {
 		startTime := time.Now()
 		defer func() {
 			log.Infof("raw_client_mset %d use %d microsecond", len(pairs)/2, time.Now().Sub(startTime)/time.Microsecond)
 		}()
 	}
-	err := r.client.MSet(pairs...).Err()
+	client := r.withContext(ctx)
+	err := client.MSet(pairs...).Err()
 	if err != nil {
-		return err
+		return redisError(err)
 	}
 	if expiration > 0 {
 		for i := 0; i < len(pairs); i = i + 2 {
 			switch pairs[i].(type) {
 			case []byte:
-				r.client.Expire(string(pairs[i].([]byte)), expiration)
+				client.Expire(string(pairs[i].([]byte)), expiration)
 			case BytesValue:
-				r.client.Expire(string(pairs[i].(BytesValue)), expiration)
+				client.Expire(string(pairs[i].(BytesValue)), expiration)
 			default:
 				log.Error("raw_client_mset expire unsupport keytype ", reflect.TypeOf(pairs[i]))
 			}
@@ -112,83 +160,221 @@ func (r redisClient) MSet(expiration time.Duration, pairs ...interface{}) error
 	return err
 }
 
-func (r redisClient) Expire(key string, expiration time.Duration) (bool, error) {
-	return r.client.Expire(key, expiration).Result()
+func (r redisClient) Expire(ctx context.Context, key string, expiration time.Duration) (bool, error) {
+	if err := contextError(ctx); err != nil {
+		return false, err
+	}
+	ok, err := r.withContext(ctx).Expire(key, expiration).Result()
+	return ok, redisError(err)
+}
+
+// TTL 返回key剩余的过期时间，key不存在返回-2，没有过期时间返回-1(和redis的TTL一致)
+func (r redisClient) TTL(ctx context.Context, key string) (time.Duration, error) {
+	if err := contextError(ctx); err != nil {
+		return 0, err
+	}
+	ttl, err := r.withContext(ctx).PTTL(key).Result()
+	// go-redis把PTTL的结果乘以了精度，-2和-1变成了-2ms和-1ms
+	switch ttl {
+	case -2 * time.Millisecond:
+		ttl = -2
+	case -1 * time.Millisecond:
+		ttl = -1
+	}
+	return ttl, redisError(err)
+}
+
+func (r redisClient) GetExpire(ctx context.Context, key string, expiration time.Duration) ([]byte, error) {
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+	if atomic.LoadInt32(&logFlag) != 0 {
+		startTime := time.Now()
+		defer func() {
+			log.Infof("raw_client_getexpire %s use %d microsecond", key, time.Now().Sub(startTime)/time.Microsecond)
+		}()
+	}
+	var getCmd *redis.StringCmd
+	_, err := r.withContext(ctx).Pipelined(func(pipe redis.Pipeliner) error {
+		getCmd = pipe.Get(key)
+		pipe.Expire(key, expiration)
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, redisError(err)
+	}
+	data, err := getCmd.Bytes()
+	if err != nil {
+		return nil, redisError(err)
+	}
+	return data, nil
 }
 
-func (r redisClient) Del(keys ...string) (int64, error) {
+func (r redisClient) MGetExpire(ctx context.Context, expiration time.Duration, keys ...string) ([]interface{}, error) {
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+	if atomic.LoadInt32(&logFlag) != 0 {
+		startTime := time.Now()
+		defer func() {
+			log.Infof("raw_client_mgetexpire %d use %d microsecond", len(keys), time.Now().Sub(startTime)/time.Microsecond)
+		}()
+	}
+	var mgetCmd *redis.SliceCmd
+	_, err := r.withContext(ctx).Pipelined(func(pipe redis.Pipeliner) error {
+		mgetCmd = pipe.MGet(keys...)
+		for _, key := range keys {
+			pipe.Expire(key, expiration)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, redisError(err)
+	}
+	return mgetCmd.Val(), nil
+}
+
+func (r redisClient) Del(ctx context.Context, keys ...string) (int64, error) {
+	if err := contextError(ctx); err != nil {
+		return 0, err
+	}
 	if atomic.LoadInt32(&logFlag) != 0 {
 		startTime := time.Now()
 		defer func() {
 			log.Infof("raw_client_del %d use %d microsecond", len(keys), time.Now().Sub(startTime)/time.Microsecond)
 		}()
 	}
-	return r.client.Del(keys...).Result()
+	n, err := r.withContext(ctx).Del(keys...).Result()
+	return n, redisError(err)
 }
 
-func (r redisClient) Incr(key string, step int64) (int64, error) {
-	return r.client.IncrBy(key, step).Result()
+func (r redisClient) Exists(ctx context.Context, keys ...string) ([]bool, error) {
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+	if atomic.LoadInt32(&logFlag) != 0 {
+		startTime := time.Now()
+		defer func() {
+			log.Infof("raw_client_exists %d use %d microsecond", len(keys), time.Now().Sub(startTime)/time.Microsecond)
+		}()
+	}
+	// EXISTS多个key时只返回存在的个数，所以每个key单独发一个EXISTS
+	cmds := make([]*redis.IntCmd, len(keys))
+	_, err := r.withContext(ctx).Pipelined(func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			cmds[i] = pipe.Exists(key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, redisError(err)
+	}
+	exists := make([]bool, len(keys))
+	for i, cmd := range cmds {
+		exists[i] = cmd.Val() > 0
+	}
+	return exists, nil
 }
 
-func (r redisClient) Decr(key string, step int64) (int64, error) {
-	return r.client.DecrBy(key, step).Result()
+func (r redisClient) Incr(ctx context.Context, key string, step int64) (int64, error) {
+	if err := contextError(ctx); err != nil {
+		return 0, err
+	}
+	n, err := r.withContext(ctx).IncrBy(key, step).Result()
+	return n, redisError(err)
+}
+
+func (r redisClient) Decr(ctx context.Context, key string, step int64) (int64, error) {
+	if err := contextError(ctx); err != nil {
+		return 0, err
+	}
+	n, err := r.withContext(ctx).DecrBy(key, step).Result()
+	return n, redisError(err)
 }
 
-func (r redisClient) ZrangeByScore(key string, max, min string, count int) ([]string, error) {
+func (r redisClient) ZrangeByScore(ctx context.Context, key string, max, min string, count int) ([]string, error) {
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
 	zrangeBy := redis.ZRangeBy{
 		Max:    max,
 		Min:    min,
 		Offset: 0,
 		Count:  int64(count),
 	}
-	stringSliceCmd := r.client.ZRangeByScore(key, zrangeBy)
-	return stringSliceCmd.Result()
+	stringSliceCmd := r.withContext(ctx).ZRangeByScore(key, zrangeBy)
+	values, err := stringSliceCmd.Result()
+	return values, redisError(err)
 }
 
-func (r redisClient) ZrevRangeByScore(key string, max, min string, count int) ([]string, error) {
+func (r redisClient) ZrevRangeByScore(ctx context.Context, key string, max, min string, count int) ([]string, error) {
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
 	zrangeBy := redis.ZRangeBy{
 		Max:    max,
 		Min:    min,
 		Offset: 0,
 		Count:  int64(count),
 	}
-	stringSliceCmd := r.client.ZRevRangeByScore(key, zrangeBy)
-	return stringSliceCmd.Result()
+	stringSliceCmd := r.withContext(ctx).ZRevRangeByScore(key, zrangeBy)
+	values, err := stringSliceCmd.Result()
+	return values, redisError(err)
 }
 
-func (r redisClient) ZAdd(key string, score float64, value interface{}) error {
+func (r redisClient) ZAdd(ctx context.Context, key string, score float64, value interface{}) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
 	z := redis.Z{
 		Score:  score,
 		Member: value,
 	}
-	intCmd := r.client.ZAdd(key, z)
+	intCmd := r.withContext(ctx).ZAdd(key, z)
 	if intCmd.Err() != nil {
-		return intCmd.Err()
+		return redisError(intCmd.Err())
 	}
 	return nil
 }
 
-func (r redisClient) ZAddM(key string, members ...redis.Z) error {
+func (r redisClient) ZAddM(ctx context.Context, key string, members ...redis.Z) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
 
-	intCmd := r.client.ZAdd(key, members...)
+	intCmd := r.withContext(ctx).ZAdd(key, members...)
 	if intCmd.Err() != nil {
-		return intCmd.Err()
+		return redisError(intCmd.Err())
 	}
 	return nil
 }
 
-func (r redisClient) ZRem(key string, value interface{}) error {
-	intCmd := r.client.ZRem(key, value)
+func (r redisClient) ZRem(ctx context.Context, key string, value interface{}) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+	intCmd := r.withContext(ctx).ZRem(key, value)
 	if intCmd.Err() != nil {
-		return intCmd.Err()
+		return redisError(intCmd.Err())
 	}
 	return nil
 }
 
-func (r redisClient) ZCount(key, max, min string) (int, error) {
-	intCmd := r.client.ZCount(key, min, max)
+func (r redisClient) ZCount(ctx context.Context, key, max, min string) (int, error) {
+	if err := contextError(ctx); err != nil {
+		return 0, err
+	}
+	intCmd := r.withContext(ctx).ZCount(key, min, max)
 	count, err := intCmd.Result()
-	return int(count), err
+	return int(count), redisError(err)
+}
+
+func (r redisClient) Scan(ctx context.Context, cursor uint64, match string, count int64) ([]string, uint64, error) {
+	if err := contextError(ctx); err != nil {
+		return nil, 0, err
+	}
+	keys, nextCursor, err := r.withContext(ctx).Scan(cursor, match, count).Result()
+	return keys, nextCursor, redisError(err)
 }
 
 var logFlag int32 = 1
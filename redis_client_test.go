@@ -0,0 +1,35 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRedisClientContext(t *testing.T) {
+	server, client := newMiniRedisClient(t)
+	server.Set("a", "1")
+
+	canceledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := client.Get(canceledCtx, "a"); !errors.Is(err, context.Canceled) {
+		t.Errorf("get with canceled ctx should fail, got %v", err)
+	}
+	if err := client.Set(canceledCtx, "b", "2", 0); !errors.Is(err, context.Canceled) {
+		t.Errorf("set with canceled ctx should fail, got %v", err)
+	}
+	if server.Exists("b") {
+		t.Error("set with canceled ctx should not be sent")
+	}
+
+	expiredCtx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	if _, err := client.MGet(expiredCtx, "a"); !IsError(err, ErrTimeout) {
+		t.Errorf("mget after deadline should be ErrTimeout, got %v", err)
+	}
+
+	if data, err := client.Get(context.Background(), "a"); err != nil || string(data) != "1" {
+		t.Errorf("get data=%q err=%v", data, err)
+	}
+}
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"context"
 	"fmt"
 	"reflect"
 	"strings"
@@ -21,6 +22,38 @@ type RedisStorage struct {
 	newObject          func() interface{}
 	order              Order // int list( ASC or DESC)
 	needBenchMark      bool
+
+	// SoftExpireTime 大于0时value会带上soft expire时间，
+	// 超过soft expire但还没有被redis过期的数据会被GetStale标记为stale，
+	// 配合StorageProxy.StaleWhileRevalidate使用，应小于DefaultExpireTime
+	SoftExpireTime time.Duration
+	// SlidingExpiration 为true时Get/MultiGet命中会把key的过期时间刷新为DefaultExpireTime
+	SlidingExpiration bool
+
+	// WriteEnvelope 为true时写入的value带上Encoding的id，读取时按id自动选择Encoding，
+	// Encoding必须用RegisterEncoding注册过，否则写入时返回error。
+	// 没有envelope的旧数据用LegacyEncoding解码(为nil时用当前Encoding)。
+	// 切换Encoding时先打开WriteEnvelope并把旧的Encoding设置为LegacyEncoding，就不需要清空缓存
+	WriteEnvelope  bool
+	LegacyEncoding Encoding
+
+	// Checksum 不为NoChecksum时写入的value带上checksum，
+	// 读取时checksum不一致返回CorruptValueError(MultiGet中当作miss)
+	Checksum ChecksumType
+
+	// ChunkSize 大于0时超过ChunkSize字节的value拆成多个chunk保存，见chunk.go。
+	// 打开后Set/MultiSet/Delete需要多读一次旧的manifest来清理旧chunk
+	ChunkSize int
+
+	// ObjectPool 不为nil时MultiGet从pool中取对象解码，代替newObject，
+	// 调用方用完MultiGet的结果后要调用Release放回
+	ObjectPool *ObjectPool
+
+	// Batch 控制MultiGet/MultiSet/Delete拆分批次和并发执行，见batch.go
+	Batch BatchOptions
+
+	// RewriteUpcasted 为true时，Get/MultiGet读到旧schema版本经过Upcaster升级的数据会写回redis
+	RewriteUpcasted bool
 }
 
 type BytesValue []byte
@@ -29,162 +62,568 @@ func (this BytesValue) MarshalBinary() (data []byte, err error) {
 	return this, nil
 }
 
+// NewRedisStorage newObject可以为nil，这时MultiGet按传入map的value类型创建对象，
+// map的value类型不是指针(比如map[Key]interface{})时MultiGet返回error，需要设置newObject或ObjectPool
 func NewRedisStorage(client RedisClient, keyPrefix string, defaultExpireTime time.Duration, encoding Encoding, newObject func() interface{}, needBenchMark bool) RedisStorage {
 	return newRedisStorage(client, keyPrefix, defaultExpireTime, 0, encoding, newObject, needBenchMark)
 }
 
 func newRedisStorage(client RedisClient, keyPrefix string, defaultExpireTime time.Duration, order Order, encoding Encoding, newObject func() interface{}, needBenchMark bool) RedisStorage {
 	keyPrefix = strings.Replace(keyPrefix, "_", "~", -1)
+	benchMarkKeyPrefix := keyPrefix
 	if needBenchMark == true {
-		return RedisStorage{client, keyPrefix, fmt.Sprintf("bench~%s", keyPrefix), defaultExpireTime, encoding, newObject, order, needBenchMark}
-	} else {
-		return RedisStorage{client, keyPrefix, keyPrefix, defaultExpireTime, encoding, newObject, order, needBenchMark}
+		benchMarkKeyPrefix = fmt.Sprintf("bench~%s", keyPrefix)
+	}
+	return RedisStorage{
+		client:             client,
+		KeyPrefix:          keyPrefix,
+		BenchMarkKeyPrefix: benchMarkKeyPrefix,
+		DefaultExpireTime:  defaultExpireTime,
+		encoding:           encoding,
+		newObject:          newObject,
+		order:              order,
+		needBenchMark:      needBenchMark,
+	}
+}
+
+func (this RedisStorage) encode(cacheKey string, object interface{}) ([]byte, error) {
+	buf, err := MarshalKey(this.encoding, cacheKey, object)
+	if err != nil {
+		return buf, err
+	}
+	env := envelope{payload: buf}
+	if version := SchemaVersionOf(object); version > 0 {
+		env.flags |= envelopeFlagSchemaVersion
+		env.schemaVersion = version
+	}
+	if this.WriteEnvelope {
+		// 没有id的value读取时只能按当前Encoding解码，切换Encoding后就读不出来了
+		id, ok := EncodingIDOf(this.encoding)
+		if !ok {
+			return nil, errors.Newf("encoding %v is not registered, WriteEnvelope needs a registered encoding", reflect.TypeOf(this.encoding))
+		}
+		env.flags |= envelopeFlagCodec
+		env.codec = id
+	}
+	if this.SoftExpireTime > 0 {
+		env.flags |= envelopeFlagSoftExpire
+		env.softExpireAt = time.Now().Add(this.SoftExpireTime).UnixNano()
+	}
+	env.flags |= this.Checksum.flag()
+	// payload本身以envelope magic开头时也要加上envelope，否则读取时会被当作envelope解析
+	if env.flags == 0 && !this.WriteEnvelope && !isEnveloped(buf) {
+		return buf, nil
+	}
+	return packEnvelope(env), nil
+}
+
+// decode readonly为true表示data指向不能修改和保留的内存(比如redis返回的string)，
+// Encoding实现了StringUnmarshaler时直接解码，否则先复制一份，
+// value实现了encoding.BinaryUnmarshaler时也复制，和Unmarshal一样解码失败时使用UnmarshalBinary
+func (this RedisStorage) decode(cacheKey string, data []byte, readonly bool, value interface{}) (env envelope, err error) {
+	env, err = unpackEnvelope(data)
+	if err != nil {
+		return
+	}
+	// 没有envelope的旧数据才用LegacyEncoding，没有codec的envelope是当前Encoding写入的
+	fallback := this.encoding
+	if this.LegacyEncoding != nil && !isEnveloped(data) {
+		fallback = this.LegacyEncoding
+	}
+	e, err := env.encoding(fallback)
+	if err != nil {
+		return
+	}
+	payload := env.payload
+	if readonly {
+		_, keyed := e.(KeyedEncoding)
+		if su, ok := e.(StringUnmarshaler); ok && !keyed && !needUpcast(value, env.schemaVersion) && !isBinaryUnmarshaler(value) {
+			err = su.UnmarshalString(bytesString(payload), value)
+			return
+		}
+		payload = append([]byte(nil), payload...)
+		env.payload = payload
+	}
+	env.upcasted, err = upcast(keyedEncoding{e, cacheKey}, payload, env.schemaVersion, value)
+	if err != nil || env.upcasted {
+		return
+	}
+	err = UnmarshalKey(e, cacheKey, payload, value)
+	return
+}
+
+// checkValueType 没有设置newObject和ObjectPool时只能按指针类型的valueType创建对象
+func (this RedisStorage) checkValueType(valueType reflect.Type) error {
+	if this.newObject == nil && this.ObjectPool == nil && (valueType == nil || valueType.Kind() != reflect.Ptr) {
+		return errors.Newf("MultiGet need newObject or ObjectPool for value type %v", valueType)
+	}
+	return nil
+}
+
+// newValue valueType是MultiGet传入的map的value类型，没有设置newObject时按它创建对象
+func (this RedisStorage) newValue(valueType reflect.Type) interface{} {
+	if this.ObjectPool != nil {
+		return this.ObjectPool.Get()
+	}
+	if this.newObject == nil && valueType != nil && valueType.Kind() == reflect.Ptr {
+		return reflect.New(valueType.Elem()).Interface()
 	}
+	return this.newObject()
 }
 
-func (this RedisStorage) Get(key Key, value interface{}) error {
+// Release 把MultiGet返回的对象放回ObjectPool，没有设置ObjectPool时什么都不做
+func (this RedisStorage) Release(valuesMap interface{}) {
+	if this.ObjectPool == nil {
+		return
+	}
+	iter := reflect.ValueOf(valuesMap).MapRange()
+	for iter.Next() {
+		this.ObjectPool.Put(iter.Value().Interface())
+	}
+}
+
+func (this RedisStorage) Get(ctx context.Context, key Key, value interface{}) error {
+	_, err := this.get(ctx, key, value)
+	return err
+}
+
+// GetStale 和Get一样，另外返回数据是否已经超过SoftExpireTime
+func (this RedisStorage) GetStale(ctx context.Context, key Key, value interface{}) (stale bool, err error) {
+	env, err := this.get(ctx, key, value)
+	if err != nil {
+		return false, err
+	}
+	return env.isStale(time.Now()), nil
+}
+
+func (this RedisStorage) get(ctx context.Context, key Key, value interface{}) (env envelope, err error) {
 	var cacheKey string
-	var err error
 	cacheKey, err = BuildCacheKey(this.KeyPrefix, key)
 	if err != nil {
-		return errors.Wrap(err, "build cache key error")
+		return env, wrapError(err, "build cache key error")
 	}
 
-	data, err := this.client.Get(cacheKey)
+	var data []byte
+	if this.isSliding() {
+		data, err = this.client.GetExpire(ctx, cacheKey, this.DefaultExpireTime)
+	} else {
+		data, err = this.client.Get(ctx, cacheKey)
+	}
 	if err != nil {
-		if err.Error() == "redis: nil" {
+		if isRedisNil(err) {
 			// log.Infoln(err)
 		} else {
-			return errors.Wrapf(err, "get from redis error key is %s", cacheKey)
+			return env, wrapErrorf(err, "get from redis error key is %s", cacheKey)
 		}
 	}
+	if data != nil {
+		var values [][]byte
+		values, err = this.assembleChunks(ctx, []string{cacheKey}, [][]byte{data})
+		if err != nil {
+			return env, wrapErrorf(err, "get from redis error key is %s", cacheKey)
+		}
+		data = values[0]
+	}
 	if data == nil {
-		return EmptyObjectError{key.String()}
+		return env, EmptyObjectError{key.String()}
 	}
-	err = Unmarshal(this.encoding, data, value)
+	env, err = this.decode(cacheKey, data, false, value)
 	// err = this.encoding.Unmarshal(data, value)
+	if corruptErr, ok := err.(CorruptValueError); ok {
+		corruptErr.Key = key.String()
+		log.Warningf("corrupt value ,key=%s,cachekey=%s reason=%s", key.String(), cacheKey, corruptErr.Reason)
+		return env, corruptErr
+	}
 	if err != nil {
-		return errors.Wrapf(err, "unmarshal json error ,key=%s,cachekey=%s type=%v ,json is %s ", key.String(), cacheKey, reflect.TypeOf(value), string(data))
+		return env, wrapErrorf(markError(ErrDecode, err), "unmarshal json error ,key=%s,cachekey=%s type=%v ,json is %s ", key.String(), cacheKey, reflect.TypeOf(value), string(data))
 	}
-	return nil
+	if env.upcasted && this.RewriteUpcasted {
+		if err := this.Set(ctx, key, value); err != nil {
+			log.Warningf("rewrite upcasted value error ,key=%s err=%v", cacheKey, err)
+		}
+	}
+	return env, nil
 }
 
-func (this RedisStorage) Add(key Key, object interface{}) error {
-	return this.Set(key, object)
+func (this RedisStorage) isSliding() bool {
+	return this.SlidingExpiration && this.DefaultExpireTime > 0
 }
 
-func (this RedisStorage) Set(key Key, object interface{}) error {
-	buf, err := Marshal(this.encoding, object)
-	// buf, err := this.encoding.Marshal(object)
+func (this RedisStorage) TTL(ctx context.Context, key Key) (time.Duration, error) {
+	return redisTTL(ctx, this.client, this.KeyPrefix, key)
+}
+
+// Touch 打开ChunkSize时同时刷新chunk的过期时间
+func (this RedisStorage) Touch(ctx context.Context, key Key, ttl time.Duration) error {
+	if err := redisTouch(ctx, this.client, this.KeyPrefix, key, ttl); err != nil {
+		return err
+	}
+	if this.ChunkSize <= 0 {
+		return nil
+	}
+	cacheKey, err := BuildCacheKey(this.KeyPrefix, key)
 	if err != nil {
-		return errors.Wrapf(err, "marshal json error,data is %+v", object)
+		return wrapError(err, "build cache key error")
 	}
-	var cacheKey string
-	cacheKey, err = BuildCacheKey(this.KeyPrefix, key)
+	return this.touchChunks(ctx, cacheKey, ttl)
+}
+
+func (this RedisStorage) Exists(ctx context.Context, keys ...Key) (map[Key]bool, error) {
+	return redisExists(ctx, this.client, this.KeyPrefix, keys)
+}
+
+// SampleValues 用SCAN从KeyPrefix下随机采样最多count个value，返回去掉envelope后的payload，
+// 用于训练压缩字典或者评估Encoding
+func (this RedisStorage) SampleValues(ctx context.Context, count int) ([][]byte, error) {
+	samples := make([][]byte, 0, count)
+	var cursor uint64
+	for len(samples) < count {
+		keys, nextCursor, err := this.client.Scan(ctx, cursor, this.KeyPrefix+"_*", int64(count))
+		if err != nil {
+			return samples, wrapError(err, "redis scan error")
+		}
+		// chunk key不是value，先去掉再计算还需要的个数
+		valueKeys := keys[:0]
+		for _, key := range keys {
+			if !isChunkKey(key) {
+				valueKeys = append(valueKeys, key)
+			}
+		}
+		keys = valueKeys
+		if len(keys) > count-len(samples) {
+			keys = keys[:count-len(samples)]
+		}
+		if len(keys) > 0 {
+			values, keyErrs := this.Batch.mget(ctx, this.client, keys, this.client.MGet)
+			if err := firstError(keyErrs); err != nil {
+				return samples, wrapError(err, "redis get error")
+			}
+			for i, value := range values {
+				if value == nil {
+					continue
+				}
+				data, err := this.assembleChunks(ctx, keys[i:i+1], [][]byte{[]byte(value.(string))})
+				if err != nil || data[0] == nil {
+					continue
+				}
+				env, err := unpackEnvelope(data[0])
+				if err != nil {
+					continue
+				}
+				samples = append(samples, env.payload)
+			}
+		}
+		if nextCursor == 0 {
+			break
+		}
+		cursor = nextCursor
+	}
+	return samples, nil
+}
+
+func (this RedisStorage) Add(ctx context.Context, key Key, object interface{}) error {
+	return this.Set(ctx, key, object)
+}
+
+func (this RedisStorage) Set(ctx context.Context, key Key, object interface{}) error {
+	cacheKey, err := BuildCacheKey(this.KeyPrefix, key)
+	if err != nil {
+		return wrapErrorf(err, "build cache key error ,key is %+v", key)
+	}
+
+	buf, err := this.encode(cacheKey, object)
+	// buf, err := this.encoding.Marshal(object)
 	if err != nil {
-		return errors.Wrap(err, "build cache key error")
+		return wrapErrorf(err, "marshal json error,data is %+v", object)
+	}
 
+	var oldChunkKeys []string
+	if this.ChunkSize > 0 {
+		oldChunkKeys, err = this.chunkKeysOf(ctx, []string{cacheKey})
+		if err != nil {
+			return err
+		}
+		if len(buf) > this.ChunkSize {
+			var chunks []interface{}
+			buf, chunks = this.splitChunks(cacheKey, buf)
+			if err = firstError(this.Batch.mset(ctx, this.client, this.chunkExpireTime(), chunks)); err != nil {
+				return wrapError(err, "redis set chunks error")
+			}
+		}
 	}
 
+	if err = this.client.Set(ctx, cacheKey, buf, this.DefaultExpireTime); err != nil {
+		return wrapError(err, "redis set error")
+	}
+	this.deleteChunks(ctx, oldChunkKeys)
+	return nil
+}
+
+func (this RedisStorage) MultiGet(ctx context.Context, keys []Key, value interface{}) error {
+	valueMap := reflect.ValueOf(value)
+	valueType := valueMap.Type().Elem()
+	if err := this.checkValueType(valueType); err != nil {
+		return err
+	}
+	newObject := func() interface{} { return this.newValue(valueType) }
+	return this.multiGet(ctx, keys, newObject, func(i int, object interface{}, err error) error {
+		if object != nil {
+			valueMap.SetMapIndex(reflect.ValueOf(keys[i]), reflect.ValueOf(object))
+		}
+		return nil
+	})
+}
+
+// MultiGetResult 是MultiGetSlice/MultiGetEach中一个key的结果，
+// Found为false且Err为nil表示key不存在，Err不为nil时是这个key的KeyError
+type MultiGetResult struct {
+	Key   Key
+	Value interface{}
+	Found bool
+	Err   error
+}
+
+// MultiGetSlice 返回和keys一一对应的结果，valueType和MultiGet传入的map的value类型含义相同，
+// 设置了newObject或ObjectPool时可以为nil
+func (this RedisStorage) MultiGetSlice(ctx context.Context, keys []Key, valueType reflect.Type) ([]MultiGetResult, error) {
+	results := make([]MultiGetResult, len(keys))
+	err := this.MultiGetEach(ctx, keys, valueType, 0, func(i int, result MultiGetResult) error {
+		results[i] = result
+		return nil
+	})
 	if err != nil {
-		return errors.Wrapf(err, "build cache key error ,key is %+v", key)
+		return nil, err
 	}
+	return results, nil
+}
 
-	if err = this.client.Set(cacheKey, buf, this.DefaultExpireTime); err != nil {
-		return errors.Wrap(err, "redis set error")
+// MultiGetEach 每次从redis取batchSize个key(<=0时一次全部取出)，按keys的顺序对每个结果调用fn，
+// fn返回error时停止并返回这个error，valueType同MultiGetSlice
+func (this RedisStorage) MultiGetEach(ctx context.Context, keys []Key, valueType reflect.Type, batchSize int, fn func(i int, result MultiGetResult) error) error {
+	if err := this.checkValueType(valueType); err != nil {
+		return err
+	}
+	if batchSize <= 0 {
+		batchSize = len(keys)
+	}
+	for offset := 0; offset < len(keys); offset += batchSize {
+		end := offset + batchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		err := this.multiGet(ctx, keys[offset:end], func() interface{} { return this.newValue(valueType) }, func(i int, object interface{}, err error) error {
+			return fn(offset+i, MultiGetResult{Key: keys[offset+i], Value: object, Found: object != nil, Err: err})
+		})
+		if _, ok := err.(*MultiError); ok && !this.Batch.FailFast {
+			// 失败的key已经作为per-key的Err交给fn
+			continue
+		}
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func (this RedisStorage) MultiGet(keys []Key, value interface{}) error {
+// multiGet 按keys的顺序对每个key调用fn，object为nil且err为nil表示miss，err是这个key的KeyError。
+// 有key失败时返回MultiError，FailFast时在第一个失败的key处返回
+func (this RedisStorage) multiGet(ctx context.Context, keys []Key, newObject func() interface{}, fn func(i int, object interface{}, err error) error) error {
 	if len(keys) == 0 {
 		return nil
 	}
+	multiErr := &MultiError{}
+	keyErrs := make([]error, len(keys))
+	fail := func(i int, stage ErrorStage, err error) {
+		keyErr := KeyError{Key: keys[i], Stage: stage, Err: err}
+		multiErr.Errors = append(multiErr.Errors, keyErr)
+		keyErrs[i] = keyErr
+	}
+
 	cacheKeys := make([]string, len(keys))
+	var fetchKeys []string
+	var fetchIndexes []int
 	for index, key := range keys {
-		var cacheKey string
-		var err error
-		cacheKey, err = BuildCacheKey(this.KeyPrefix, key)
+		cacheKey, err := BuildCacheKey(this.KeyPrefix, key)
 		if err != nil {
-			return errors.Wrapf(err, "build cache key error ,key is %+v", key)
+			fail(index, StageBuildKey, err)
+			if this.Batch.FailFast {
+				return multiErr
+			}
+			continue
 		}
 		cacheKeys[index] = cacheKey
+		fetchKeys = append(fetchKeys, cacheKey)
+		fetchIndexes = append(fetchIndexes, index)
 	}
 
-	val, err := this.client.MGet(cacheKeys...)
+	get := this.client.MGet
+	if this.isSliding() {
+		get = func(ctx context.Context, keys ...string) ([]interface{}, error) {
+			return this.client.MGetExpire(ctx, this.DefaultExpireTime, keys...)
+		}
+	}
+	val, redisErrs := this.Batch.mget(ctx, this.client, fetchKeys, get)
+	values := make([][]byte, len(keys))
+	for j, i := range fetchIndexes {
+		if redisErrs != nil && redisErrs[j] != nil {
+			fail(i, StageRedis, redisErrs[j])
+			continue
+		}
+		if val[j] != nil {
+			values[i] = stringBytes(val[j].(string))
+		}
+	}
+	if this.Batch.FailFast && len(multiErr.Errors) > 0 {
+		return multiErr
+	}
+	values, err := this.assembleChunks(ctx, cacheKeys, values)
 	if err != nil {
-		return errors.Wrap(err, "redis get error")
+		return err
 	}
 
-	valueMap := reflect.ValueOf(value)
-	for i, value := range val {
+	var upcastedMap map[Key]interface{}
+	for i, value := range values {
+		if keyErrs[i] != nil {
+			if err := fn(i, nil, keyErrs[i]); err != nil {
+				return err
+			}
+			continue
+		}
 		if value == nil {
+			if err := fn(i, nil, nil); err != nil {
+				return err
+			}
 			continue
 		}
-		object := this.newObject()
-		// err := this.encoding.Unmarshal([]byte(value.(string)), object)
-		err = Unmarshal(this.encoding, []byte(value.(string)), object)
+		object := newObject()
+		// err := this.encoding.Unmarshal(value, object)
+		env, err := this.decode(cacheKeys[i], value, true, object)
 		if err != nil {
-			log.Warning("cant't unmarshal json ", keys[i].String(), cacheKeys[i], reflect.TypeOf(object), value)
+			if corruptErr, ok := err.(CorruptValueError); ok {
+				corruptErr.Key = keys[i].String()
+				err = corruptErr
+			}
+			log.Warning("cant't unmarshal json ", keys[i].String(), cacheKeys[i], reflect.TypeOf(object), err)
+			if this.ObjectPool != nil {
+				this.ObjectPool.Put(object)
+			}
+			fail(i, StageDecode, err)
+			if err := fn(i, nil, keyErrs[i]); err != nil {
+				return err
+			}
+			if this.Batch.FailFast {
+				return multiErr
+			}
 			continue
 		}
-		valueMap.SetMapIndex(reflect.ValueOf(keys[i]), reflect.ValueOf(object))
+		if err := fn(i, object, nil); err != nil {
+			return err
+		}
+		if env.upcasted && this.RewriteUpcasted {
+			if upcastedMap == nil {
+				upcastedMap = make(map[Key]interface{})
+			}
+			upcastedMap[keys[i]] = object
+		}
 	}
-	return nil
+	if len(upcastedMap) > 0 {
+		if err := this.MultiSet(ctx, upcastedMap); err != nil {
+			log.Warningf("rewrite upcasted values error %v", err)
+		}
+	}
+	return multiErr.ErrorOrNil()
 }
 
-func (this RedisStorage) MultiSet(valueMap map[Key]interface{}) error {
+// MultiSet build key或者encode失败的key不会写入，和redis写入失败的key一起通过MultiError返回
+func (this RedisStorage) MultiSet(ctx context.Context, valueMap map[Key]interface{}) error {
 	if len(valueMap) == 0 {
 		return nil
 	}
+	multiErr := &MultiError{}
 	values := make([]interface{}, 0, 2*len(valueMap))
+	pairKeys := make([]Key, 0, len(valueMap))
+	var chunks []interface{}
+	var cacheKeys []string
 	for key, value := range valueMap {
-		// buf, err := this.encoding.Marshal(value)
-		buf, err := Marshal(this.encoding, value)
+		cacheKey, err := BuildCacheKey(this.KeyPrefix, key)
 		if err != nil {
-			log.Warningf("cant't unmarshal json ,json string is %+v", value)
+			log.Warningf("build cache key error ,key is %+v", key)
+			multiErr.Add(key, StageBuildKey, err)
+			if this.Batch.FailFast {
+				return multiErr
+			}
 			continue
 		}
-		var cacheKey string
-		cacheKey, err = BuildCacheKey(this.KeyPrefix, key)
+		// buf, err := this.encoding.Marshal(value)
+		buf, err := this.encode(cacheKey, value)
 		if err != nil {
-			log.Warningf("build cache key error ,key is %+v", key)
+			log.Warningf("cant't unmarshal json ,json string is %+v", value)
+			multiErr.Add(key, StageEncode, err)
+			if this.Batch.FailFast {
+				return multiErr
+			}
 			continue
 		}
+		if this.ChunkSize > 0 {
+			cacheKeys = append(cacheKeys, cacheKey)
+			if len(buf) > this.ChunkSize {
+				var valueChunks []interface{}
+				buf, valueChunks = this.splitChunks(cacheKey, buf)
+				chunks = append(chunks, valueChunks...)
+			}
+		}
 		values = append(values, ([]byte(cacheKey)))
 		values = append(values, (buf))
+		pairKeys = append(pairKeys, key)
 	}
 
-	err := this.client.MSet(this.DefaultExpireTime, values...)
+	oldChunkKeys, err := this.chunkKeysOf(ctx, cacheKeys)
 	if err != nil {
-		return errors.Wrap(err, "redis set error")
+		return err
 	}
-	return nil
+	if len(chunks) > 0 {
+		if err := firstError(this.Batch.mset(ctx, this.client, this.chunkExpireTime(), chunks)); err != nil {
+			return wrapError(err, "redis set chunks error")
+		}
+	}
+	multiErr.addAll(pairKeys, StageRedis, this.Batch.mset(ctx, this.client, this.DefaultExpireTime, values))
+	this.deleteChunks(ctx, oldChunkKeys)
+	return multiErr.ErrorOrNil()
 }
 
-func (this RedisStorage) Delete(keyList ...Key) error {
+// Delete build key失败的key不会删除，和redis删除失败的key一起通过MultiError返回
+func (this RedisStorage) Delete(ctx context.Context, keyList ...Key) error {
 	if len(keyList) == 0 {
 		return nil
 	}
-	var cacheKeyList []string = make([]string, len(keyList))
-	var err error
-	for storagekeyIdx, key := range keyList {
-		var cacheKey string
-		cacheKey, err = BuildCacheKey(this.KeyPrefix, key)
+	multiErr := &MultiError{}
+	cacheKeyList := make([]string, 0, len(keyList))
+	keys := make([]Key, 0, len(keyList))
+	for _, key := range keyList {
+		cacheKey, err := BuildCacheKey(this.KeyPrefix, key)
 		if err != nil {
 			log.Warningf("build cache key error ,key is %+v", key)
+			multiErr.Add(key, StageBuildKey, err)
+			if this.Batch.FailFast {
+				return multiErr
+			}
 			continue
 		}
+		cacheKeyList = append(cacheKeyList, cacheKey)
+		keys = append(keys, key)
+	}
 
-		cacheKeyList[storagekeyIdx] = cacheKey
+	var chunkKeys []string
+	if this.ChunkSize > 0 {
+		var err error
+		chunkKeys, err = this.chunkKeysOf(ctx, cacheKeyList)
 		if err != nil {
-			return errors.Wrapf(err, "build cache key error ,key is %+v", key)
+			return err
 		}
 	}
 
-	_, err = this.client.Del(cacheKeyList...)
-	if err != nil {
-		return errors.Wrapf(err, "redis delete error,keys is %+v", keyList)
-	}
-	return nil
+	_, keyErrs := this.Batch.del(ctx, this.client, cacheKeyList)
+	multiErr.addAll(keys, StageRedis, keyErrs)
+	this.deleteChunks(ctx, chunkKeys)
+	return multiErr.ErrorOrNil()
 }
@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+type benchmarkUser struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+func benchmarkMultiGet(b *testing.B, pool bool) {
+	ctx := context.Background()
+	client := newMockRedisClient()
+	storage := NewRedisStorage(client, "user", 0, JsonEncoding{}, func() interface{} { return new(benchmarkUser) }, false)
+	if pool {
+		storage.ObjectPool = NewObjectPool(func() interface{} { return new(benchmarkUser) }, nil)
+	}
+	keys := make([]Key, 500)
+	valueMap := make(map[Key]interface{}, len(keys))
+	for i := range keys {
+		keys[i] = Int(i)
+		valueMap[keys[i]] = &benchmarkUser{ID: int64(i), Name: "user"}
+	}
+	if err := storage.MultiSet(ctx, valueMap); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		result := make(map[Key]*benchmarkUser, len(keys))
+		if err := storage.MultiGet(ctx, keys, result); err != nil {
+			b.Fatal(err)
+		}
+		storage.Release(result)
+	}
+}
+
+func BenchmarkRedisStorageMultiGet(b *testing.B) {
+	benchmarkMultiGet(b, false)
+}
+
+func BenchmarkRedisStorageMultiGetPooled(b *testing.B) {
+	benchmarkMultiGet(b, true)
+}
+
+func TestRedisStorageMultiGetSlice(t *testing.T) {
+	ctx := context.Background()
+	client := newMockRedisClient()
+	storage := NewRedisStorage(client, "slice", 0, JsonEncoding{}, func() interface{} { return new(string) }, false)
+	storage.MultiSet(ctx, map[Key]interface{}{String("1"): "a", String("3"): "c"})
+	client.values["slice_2"] = "{bad json"
+
+	keys := []Key{String("3"), String("2"), String("1"), String("4")}
+	results, err := storage.MultiGetSlice(ctx, keys, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(keys) {
+		t.Fatalf("results should be aligned with keys, got %d", len(results))
+	}
+	if !results[0].Found || *results[0].Value.(*string) != "c" || !results[2].Found || *results[2].Value.(*string) != "a" {
+		t.Errorf("found values mismatch, results=%+v", results)
+	}
+	if results[1].Found || results[1].Err == nil {
+		t.Errorf("undecodable value should carry an error, result=%+v", results[1])
+	}
+	if results[3].Found || results[3].Err != nil {
+		t.Errorf("missing key should be not found without error, result=%+v", results[3])
+	}
+
+	var visited []int
+	err = storage.MultiGetEach(ctx, keys, nil, 1, func(i int, result MultiGetResult) error {
+		visited = append(visited, i)
+		if i == 2 {
+			return errors.New("stop")
+		}
+		return nil
+	})
+	if err == nil || len(visited) != 3 || visited[0] != 0 || visited[2] != 2 {
+		t.Errorf("MultiGetEach should visit in order and stop on error, visited=%v err=%v", visited, err)
+	}
+}
+
+func TestRedisStorageMultiGetWithoutNewObject(t *testing.T) {
+	ctx := context.Background()
+	client := newMockRedisClient()
+	storage := NewRedisStorage(client, "user", 0, JsonEncoding{}, nil, false)
+	storage.Set(ctx, Int(1), &benchmarkUser{ID: 1, Name: "a"})
+
+	// 指针类型按map的value类型创建对象
+	users := make(map[Key]*benchmarkUser)
+	if err := storage.MultiGet(ctx, []Key{Int(1)}, users); err != nil || users[Int(1)] == nil || users[Int(1)].Name != "a" {
+		t.Errorf("MultiGet into pointer map should work without newObject, users=%v err=%v", users, err)
+	}
+
+	values := make(map[Key]interface{})
+	if err := storage.MultiGet(ctx, []Key{Int(1)}, values); err == nil {
+		t.Error("MultiGet into interface map without newObject should fail")
+	}
+}
+
+// binaryPoint json无法序列化(有func字段)，Encoding失败时使用MarshalBinary/UnmarshalBinary
+type binaryPoint struct {
+	X, Y   int
+	Format func() string
+}
+
+func (this *binaryPoint) MarshalBinary() ([]byte, error) {
+	return []byte(fmt.Sprintf("%d,%d", this.X, this.Y)), nil
+}
+
+func (this *binaryPoint) UnmarshalBinary(data []byte) error {
+	_, err := fmt.Sscanf(string(data), "%d,%d", &this.X, &this.Y)
+	return err
+}
+
+func TestRedisStorageBinaryUnmarshalerFallback(t *testing.T) {
+	ctx := context.Background()
+	storage := NewRedisStorage(newMockRedisClient(), "point", 0, JsonEncoding{}, nil, false)
+	if err := storage.Set(ctx, Int(1), &binaryPoint{X: 1, Y: 2}); err != nil {
+		t.Fatal(err)
+	}
+	var point binaryPoint
+	if err := storage.Get(ctx, Int(1), &point); err != nil || point.X != 1 || point.Y != 2 {
+		t.Errorf("get should fall back to UnmarshalBinary, point=%+v err=%v", point, err)
+	}
+	points := make(map[Key]*binaryPoint)
+	if err := storage.MultiGet(ctx, []Key{Int(1)}, points); err != nil || points[Int(1)] == nil || points[Int(1)].Y != 2 {
+		t.Errorf("MultiGet should fall back to UnmarshalBinary like Get, points=%v err=%v", points, err)
+	}
+
+	point = binaryPoint{}
+	if err := UnmarshalString(JsonEncoding{}, "3,4", &point); err != nil || point.X != 3 || point.Y != 4 {
+		t.Errorf("UnmarshalString should fall back to UnmarshalBinary, point=%+v err=%v", point, err)
+	}
+}
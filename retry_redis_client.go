@@ -0,0 +1,246 @@
+package storage
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/go-redis/redis"
+	log "github.com/golang/glog"
+)
+
+const (
+	defaultMinRetryBackoff = 8 * time.Millisecond
+	defaultMaxRetryBackoff = 512 * time.Millisecond
+)
+
+// RetryPolicy 控制RetryRedisClient的重试
+type RetryPolicy struct {
+	// MaxRetries 最多重试的次数，<=0时不重试
+	MaxRetries int
+	// MinBackoff/MaxBackoff 第n次重试前等待MinBackoff*2^(n-1)，不超过MaxBackoff，
+	// 为0时分别是8ms和512ms
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Jitter 取值0~1，等待时间在[backoff*(1-Jitter), backoff]之间随机，避免同时重试
+	Jitter float64
+	// Retryable 判断error是否可以重试，为nil时只重试ErrTimeout和ErrUnavailable
+	Retryable func(err error) bool
+}
+
+// backoff 第attempt次重试前等待的时间，attempt从1开始
+func (this RetryPolicy) backoff(attempt int) time.Duration {
+	minBackoff, maxBackoff := this.MinBackoff, this.MaxBackoff
+	if minBackoff <= 0 {
+		minBackoff = defaultMinRetryBackoff
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = defaultMaxRetryBackoff
+	}
+	d := minBackoff
+	for i := 1; i < attempt && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	if this.Jitter > 0 {
+		jitter := this.Jitter
+		if jitter > 1 {
+			jitter = 1
+		}
+		d -= time.Duration(rand.Float64() * jitter * float64(d))
+	}
+	return d
+}
+
+func (this RetryPolicy) retryable(err error) bool {
+	if this.Retryable != nil {
+		return this.Retryable(err)
+	}
+	return IsError(err, ErrTimeout) || IsError(err, ErrUnavailable)
+}
+
+// retryRedisClient 按RetryPolicy重试幂等的命令，
+// Incr/Decr不是幂等的(失败时可能已经执行)，直接交给被包装的RedisClient
+type retryRedisClient struct {
+	RedisClient
+	policy RetryPolicy
+}
+
+// retryShardedRedisClient 被包装的client是ShardedRedisClient时保留ShardOf，multi-key操作仍然按shard拆分
+type retryShardedRedisClient struct {
+	retryRedisClient
+	sharded ShardedRedisClient
+}
+
+func (this retryShardedRedisClient) ShardOf(key string) int {
+	return this.sharded.ShardOf(key)
+}
+
+// NewRetryRedisClient 包装client，幂等命令遇到policy.Retryable的error时按指数退避重试。
+// ctx结束或者等待时间会超过ctx的deadline时不再重试，返回最后一次的error。
+// Del重试时前一次可能已经删除成功，返回的个数可能偏小
+func NewRetryRedisClient(client RedisClient, policy RetryPolicy) RedisClient {
+	retryClient := retryRedisClient{RedisClient: client, policy: policy}
+	if sharded, ok := client.(ShardedRedisClient); ok {
+		return retryShardedRedisClient{retryClient, sharded}
+	}
+	return retryClient
+}
+
+// do 执行fn，失败时按policy重试
+func (this retryRedisClient) do(ctx context.Context, name string, fn func() error) error {
+	err := fn()
+	for attempt := 1; err != nil && attempt <= this.policy.MaxRetries && this.policy.retryable(err); attempt++ {
+		if ctx.Err() != nil {
+			return err
+		}
+		backoff := this.policy.backoff(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < backoff {
+			return err
+		}
+		log.Warningf("redis %s retry %d after %v ,err=%v", name, attempt, backoff, err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+		err = fn()
+	}
+	return err
+}
+
+func (this retryRedisClient) Ping(ctx context.Context) error {
+	return this.do(ctx, "ping", func() error {
+		return this.RedisClient.Ping(ctx)
+	})
+}
+
+func (this retryRedisClient) Get(ctx context.Context, key string) (data []byte, err error) {
+	err = this.do(ctx, "get", func() error {
+		data, err = this.RedisClient.Get(ctx, key)
+		return err
+	})
+	return data, err
+}
+
+func (this retryRedisClient) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) error {
+	return this.do(ctx, "set", func() error {
+		return this.RedisClient.Set(ctx, key, value, expiration)
+	})
+}
+
+func (this retryRedisClient) MGet(ctx context.Context, keys ...string) (values []interface{}, err error) {
+	err = this.do(ctx, "mget", func() error {
+		values, err = this.RedisClient.MGet(ctx, keys...)
+		return err
+	})
+	return values, err
+}
+
+func (this retryRedisClient) MSet(ctx context.Context, expiration time.Duration, pairs ...interface{}) error {
+	return this.do(ctx, "mset", func() error {
+		return this.RedisClient.MSet(ctx, expiration, pairs...)
+	})
+}
+
+func (this retryRedisClient) Expire(ctx context.Context, key string, expiration time.Duration) (ok bool, err error) {
+	err = this.do(ctx, "expire", func() error {
+		ok, err = this.RedisClient.Expire(ctx, key, expiration)
+		return err
+	})
+	return ok, err
+}
+
+func (this retryRedisClient) TTL(ctx context.Context, key string) (ttl time.Duration, err error) {
+	err = this.do(ctx, "ttl", func() error {
+		ttl, err = this.RedisClient.TTL(ctx, key)
+		return err
+	})
+	return ttl, err
+}
+
+func (this retryRedisClient) GetExpire(ctx context.Context, key string, expiration time.Duration) (data []byte, err error) {
+	err = this.do(ctx, "getexpire", func() error {
+		data, err = this.RedisClient.GetExpire(ctx, key, expiration)
+		return err
+	})
+	return data, err
+}
+
+func (this retryRedisClient) MGetExpire(ctx context.Context, expiration time.Duration, keys ...string) (values []interface{}, err error) {
+	err = this.do(ctx, "mgetexpire", func() error {
+		values, err = this.RedisClient.MGetExpire(ctx, expiration, keys...)
+		return err
+	})
+	return values, err
+}
+
+func (this retryRedisClient) Del(ctx context.Context, keys ...string) (n int64, err error) {
+	err = this.do(ctx, "del", func() error {
+		n, err = this.RedisClient.Del(ctx, keys...)
+		return err
+	})
+	return n, err
+}
+
+func (this retryRedisClient) Exists(ctx context.Context, keys ...string) (exists []bool, err error) {
+	err = this.do(ctx, "exists", func() error {
+		exists, err = this.RedisClient.Exists(ctx, keys...)
+		return err
+	})
+	return exists, err
+}
+
+func (this retryRedisClient) ZrangeByScore(ctx context.Context, key string, max, min string, count int) (values []string, err error) {
+	err = this.do(ctx, "zrangebyscore", func() error {
+		values, err = this.RedisClient.ZrangeByScore(ctx, key, max, min, count)
+		return err
+	})
+	return values, err
+}
+
+func (this retryRedisClient) ZrevRangeByScore(ctx context.Context, key string, max, min string, count int) (values []string, err error) {
+	err = this.do(ctx, "zrevrangebyscore", func() error {
+		values, err = this.RedisClient.ZrevRangeByScore(ctx, key, max, min, count)
+		return err
+	})
+	return values, err
+}
+
+func (this retryRedisClient) ZAdd(ctx context.Context, key string, score float64, value interface{}) error {
+	return this.do(ctx, "zadd", func() error {
+		return this.RedisClient.ZAdd(ctx, key, score, value)
+	})
+}
+
+func (this retryRedisClient) ZAddM(ctx context.Context, key string, members ...redis.Z) error {
+	return this.do(ctx, "zaddm", func() error {
+		return this.RedisClient.ZAddM(ctx, key, members...)
+	})
+}
+
+func (this retryRedisClient) ZRem(ctx context.Context, key string, value interface{}) error {
+	return this.do(ctx, "zrem", func() error {
+		return this.RedisClient.ZRem(ctx, key, value)
+	})
+}
+
+func (this retryRedisClient) ZCount(ctx context.Context, key, max, min string) (count int, err error) {
+	err = this.do(ctx, "zcount", func() error {
+		count, err = this.RedisClient.ZCount(ctx, key, max, min)
+		return err
+	})
+	return count, err
+}
+
+func (this retryRedisClient) Scan(ctx context.Context, cursor uint64, match string, count int64) (keys []string, nextCursor uint64, err error) {
+	err = this.do(ctx, "scan", func() error {
+		keys, nextCursor, err = this.RedisClient.Scan(ctx, cursor, match, count)
+		return err
+	})
+	return keys, nextCursor, err
+}
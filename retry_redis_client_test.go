@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyRedisClient 前failures次Get/Incr返回ErrUnavailable
+type flakyRedisClient struct {
+	*mockRedisClient
+	failures int32
+	calls    int32
+}
+
+var errFlaky = markError(ErrUnavailable, errors.New("connection reset"))
+
+func (this *flakyRedisClient) fail() bool {
+	return atomic.AddInt32(&this.calls, 1) <= this.failures
+}
+
+func (this *flakyRedisClient) Get(ctx context.Context, key string) ([]byte, error) {
+	if this.fail() {
+		return nil, errFlaky
+	}
+	return this.mockRedisClient.Get(ctx, key)
+}
+
+func (this *flakyRedisClient) Incr(ctx context.Context, key string, step int64) (int64, error) {
+	if this.fail() {
+		return 0, errFlaky
+	}
+	return this.mockRedisClient.Incr(ctx, key, step)
+}
+
+func TestRetryRedisClient(t *testing.T) {
+	ctx := context.Background()
+	policy := RetryPolicy{MaxRetries: 3, MinBackoff: time.Millisecond, MaxBackoff: 4 * time.Millisecond, Jitter: 0.5}
+
+	flaky := &flakyRedisClient{mockRedisClient: newMockRedisClient(), failures: 2}
+	flaky.Set(ctx, "a", "1", 0)
+	client := NewRetryRedisClient(flaky, policy)
+	if data, err := client.Get(ctx, "a"); err != nil || string(data) != "1" {
+		t.Errorf("get should succeed after retries, data=%s err=%v", data, err)
+	}
+	if calls := atomic.LoadInt32(&flaky.calls); calls != 3 {
+		t.Errorf("get should be called 3 times, got %d", calls)
+	}
+
+	// key不存在不重试
+	atomic.StoreInt32(&flaky.calls, 0)
+	flaky.failures = 0
+	if _, err := client.Get(ctx, "missing"); !isRedisNil(err) {
+		t.Errorf("missing key should be not found, got %v", err)
+	}
+	if calls := atomic.LoadInt32(&flaky.calls); calls != 1 {
+		t.Errorf("not found should not be retried, got %d calls", calls)
+	}
+
+	// Incr不是幂等的，不重试
+	atomic.StoreInt32(&flaky.calls, 0)
+	flaky.failures = 1
+	if _, err := client.Incr(ctx, "n", 1); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("incr should return the first error, got %v", err)
+	}
+	if calls := atomic.LoadInt32(&flaky.calls); calls != 1 {
+		t.Errorf("incr should not be retried, got %d calls", calls)
+	}
+
+	// 超过MaxRetries返回最后一次的error
+	atomic.StoreInt32(&flaky.calls, 0)
+	flaky.failures = 10
+	if _, err := client.Get(ctx, "a"); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("get should fail after max retries, got %v", err)
+	}
+	if calls := atomic.LoadInt32(&flaky.calls); calls != 4 {
+		t.Errorf("get should be called 1+3 times, got %d", calls)
+	}
+}
+
+func TestRetryRedisClientDeadline(t *testing.T) {
+	flaky := &flakyRedisClient{mockRedisClient: newMockRedisClient(), failures: 10}
+	client := NewRetryRedisClient(flaky, RetryPolicy{MaxRetries: 5, MinBackoff: time.Second, MaxBackoff: time.Second})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	startTime := time.Now()
+	if _, err := client.Get(ctx, "a"); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("get should return the last error, got %v", err)
+	}
+	if elapsed := time.Since(startTime); elapsed > 50*time.Millisecond {
+		t.Errorf("backoff beyond the deadline should not wait, took %v", elapsed)
+	}
+	if calls := atomic.LoadInt32(&flaky.calls); calls != 1 {
+		t.Errorf("backoff beyond the deadline should not retry, got %d calls", calls)
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{MinBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	expected := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond, 50 * time.Millisecond, 50 * time.Millisecond}
+	for i, d := range expected {
+		if backoff := policy.backoff(i + 1); backoff != d {
+			t.Errorf("backoff %d should be %v, got %v", i+1, d, backoff)
+		}
+	}
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if backoff := policy.backoff(2); backoff < 10*time.Millisecond || backoff > 20*time.Millisecond {
+			t.Errorf("jittered backoff should be in [10ms, 20ms], got %v", backoff)
+		}
+	}
+}
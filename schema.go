@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/dropbox/godropbox/errors"
+)
+
+// Upcaster 把版本为fromVersion的payload转换成fromVersion+1版本的对象，
+// data是用e编码的旧数据，返回值可以是对象本身也可以是对象的指针
+type Upcaster func(data []byte, e Encoding) (interface{}, error)
+
+type schema struct {
+	version   uint32
+	upcasters map[uint32]Upcaster
+}
+
+var (
+	schemaRegistryLock sync.RWMutex
+	schemaRegistry     = make(map[reflect.Type]*schema)
+)
+
+func schemaType(sample interface{}) reflect.Type {
+	typ := reflect.TypeOf(sample)
+	for typ != nil && typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	return typ
+}
+
+// RegisterSchemaVersion 设置sample类型当前的schema版本，
+// 注册过的类型写入时会在envelope中带上版本号，没有版本号的旧数据当作版本0
+func RegisterSchemaVersion(sample interface{}, version uint32) {
+	typ := schemaType(sample)
+	schemaRegistryLock.Lock()
+	defer schemaRegistryLock.Unlock()
+	s, ok := schemaRegistry[typ]
+	if !ok {
+		s = &schema{upcasters: make(map[uint32]Upcaster)}
+		schemaRegistry[typ] = s
+	}
+	s.version = version
+}
+
+// RegisterUpcaster 注册sample类型从fromVersion升级到fromVersion+1的Upcaster
+func RegisterUpcaster(sample interface{}, fromVersion uint32, upcaster Upcaster) {
+	typ := schemaType(sample)
+	schemaRegistryLock.Lock()
+	defer schemaRegistryLock.Unlock()
+	s, ok := schemaRegistry[typ]
+	if !ok {
+		s = &schema{upcasters: make(map[uint32]Upcaster)}
+		schemaRegistry[typ] = s
+	}
+	s.upcasters[fromVersion] = upcaster
+}
+
+// SchemaVersionOf 返回sample类型当前的schema版本，没有注册时返回0
+func SchemaVersionOf(sample interface{}) uint32 {
+	return schemaVersion(schemaType(sample))
+}
+
+func schemaVersion(typ reflect.Type) uint32 {
+	schemaRegistryLock.RLock()
+	defer schemaRegistryLock.RUnlock()
+	if s, ok := schemaRegistry[typ]; ok {
+		return s.version
+	}
+	return 0
+}
+
+// needUpcast 判断value的类型是否需要从fromVersion升级
+func needUpcast(value interface{}, fromVersion uint32) bool {
+	return fromVersion < schemaVersion(schemaType(value))
+}
+
+// upcast 把版本为fromVersion的data逐级升级到当前版本并写入value，
+// 中间版本的对象用e重新编码后交给下一个Upcaster
+func upcast(e Encoding, data []byte, fromVersion uint32, value interface{}) (upcasted bool, err error) {
+	typ := schemaType(value)
+	schemaRegistryLock.RLock()
+	s, ok := schemaRegistry[typ]
+	schemaRegistryLock.RUnlock()
+	if !ok || fromVersion >= s.version {
+		return false, nil
+	}
+
+	var object interface{}
+	for version := fromVersion; version < s.version; version++ {
+		upcaster, ok := s.upcasters[version]
+		if !ok {
+			return false, errors.Newf("no upcaster registered for %v from version %d", typ, version)
+		}
+		if version > fromVersion {
+			data, err = Marshal(e, object)
+			if err != nil {
+				return false, errors.Wrapf(err, "marshal %v version %d error", typ, version)
+			}
+		}
+		object, err = upcaster(data, e)
+		if err != nil {
+			return false, errors.Wrapf(err, "upcast %v from version %d error", typ, version)
+		}
+	}
+
+	dst := reflect.ValueOf(value)
+	if dst.Kind() != reflect.Ptr || dst.IsNil() {
+		return false, errors.Newf("upcast target %v is not a pointer", reflect.TypeOf(value))
+	}
+	dst = dst.Elem()
+	src := reflect.ValueOf(object)
+	if src.Kind() == reflect.Ptr && !src.Type().AssignableTo(dst.Type()) && !src.IsNil() {
+		src = src.Elem()
+	}
+	if !src.IsValid() || !src.Type().AssignableTo(dst.Type()) {
+		return false, errors.Newf("upcaster for %v returned %v", typ, reflect.TypeOf(object))
+	}
+	dst.Set(src)
+	return true, nil
+}
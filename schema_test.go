@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+type schemaTestUser struct {
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Age       int    `json:"age"`
+}
+
+func TestUpcast(t *testing.T) {
+	RegisterSchemaVersion(schemaTestUser{}, 2)
+	// v0: {"name":"a b"}
+	RegisterUpcaster(schemaTestUser{}, 0, func(data []byte, e Encoding) (interface{}, error) {
+		var v0 struct {
+			Name string `json:"name"`
+		}
+		if err := e.Unmarshal(data, &v0); err != nil {
+			return nil, err
+		}
+		return map[string]string{"first_name": v0.Name}, nil
+	})
+	// v1: {"first_name":"a b"}
+	RegisterUpcaster(schemaTestUser{}, 1, func(data []byte, e Encoding) (interface{}, error) {
+		var user schemaTestUser
+		if err := e.Unmarshal(data, &user); err != nil {
+			return nil, err
+		}
+		user.Age = 18
+		return &user, nil
+	})
+
+	storage := RedisStorage{encoding: JsonEncoding{}}
+	var user schemaTestUser
+	env, err := storage.decode("", []byte(`{"name":"a b"}`), true, &user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !env.upcasted || user.FirstName != "a b" || user.Age != 18 {
+		t.Errorf("upcast failed, upcasted=%v user=%+v", env.upcasted, user)
+	}
+
+	data, err := storage.encode("", &user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, err = unpackEnvelope(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.schemaVersion != 2 {
+		t.Errorf("schema version should be 2, got %d", env.schemaVersion)
+	}
+	var decoded schemaTestUser
+	if err = json.Unmarshal(env.payload, &decoded); err != nil || decoded != user {
+		t.Errorf("payload should be current version json, got %s err=%v", env.payload, err)
+	}
+}
@@ -1,24 +1,42 @@
 package storage
 
 import (
+	"context"
 	"reflect"
+	"sync"
+	"time"
 
 	log "github.com/golang/glog"
-	"github.com/1024casts/go-common/context"
+	"github.com/dropbox/godropbox/errors"
 )
 
 type Storage interface {
-	Get(ctx *context.Context, key Key, value interface{}) error
-	Set(ctx *context.Context, key Key, object interface{}) error
-	Add(ctx *context.Context, key Key, object interface{}) error
-	MultiGet(ctx *context.Context, keys []Key, valuesMap interface{}) error
-	MultiSet(ctx *context.Context, values map[Key]interface{}) error
-	Delete(ctx *context.Context, key ...Key) error
+	Get(ctx context.Context, key Key, value interface{}) error
+	Set(ctx context.Context, key Key, object interface{}) error
+	Add(ctx context.Context, key Key, object interface{}) error
+	MultiGet(ctx context.Context, keys []Key, valuesMap interface{}) error
+	MultiSet(ctx context.Context, values map[Key]interface{}) error
+	Delete(ctx context.Context, key ...Key) error
+}
+
+// StaleGetter 由value带有soft expire的Storage实现(比如设置了SoftExpireTime的RedisStorage)
+type StaleGetter interface {
+	GetStale(ctx context.Context, key Key, value interface{}) (stale bool, err error)
 }
 
 type StorageProxy struct {
 	PreferedStorage Storage
 	BackupStorage   Storage
+
+	// StaleWhileRevalidate 为true且PreferedStorage实现了StaleGetter时，
+	// Get到已经超过soft expire的数据会直接返回，同时在后台从BackupStorage刷新，
+	// 同一个key同时只会有一个刷新在进行
+	StaleWhileRevalidate bool
+	// RevalidateTimeout 后台刷新的超时时间，为0时是10秒
+	RevalidateTimeout time.Duration
+
+	revalidateLock sync.Mutex
+	revalidating   map[Key]struct{}
 }
 
 func NewStorageProxy(prefered, backup Storage) *StorageProxy {
@@ -28,17 +46,14 @@ func NewStorageProxy(prefered, backup Storage) *StorageProxy {
 	}
 }
 
-func (this *StorageProxy) Get(ctx *context.Context, key Key, value interface{}) error {
+func (this *StorageProxy) Get(ctx context.Context, key Key, value interface{}) error {
+	if staleGetter, ok := this.PreferedStorage.(StaleGetter); ok && this.StaleWhileRevalidate {
+		return this.getStaleWhileRevalidate(ctx, staleGetter, key, value)
+	}
 	err := this.PreferedStorage.Get(ctx, key, value)
-	if err != nil && reflect.TypeOf(err).Name() == "EmptyObjectError" {
-		err = this.BackupStorage.Get(ctx, key, value)
-		if err != nil {
-			return err
-		}
-		err = this.PreferedStorage.Set(ctx, key, value)
-		if err != nil {
-			return err
-		}
+	if err != nil && (IsErrorEmpty(err) || IsErrorCorrupt(err)) {
+		// 数据损坏时当作miss，用BackupStorage的数据覆盖
+		return this.getFromBackup(ctx, key, value)
 	}
 	if err != nil {
 		return err
@@ -46,7 +61,84 @@ func (this *StorageProxy) Get(ctx *context.Context, key Key, value interface{})
 	return nil
 }
 
-func (this *StorageProxy) Add(ctx *context.Context, key Key, object interface{}) error {
+func (this *StorageProxy) getFromBackup(ctx context.Context, key Key, value interface{}) error {
+	// 调用方已经放弃时不再回源
+	if err := ctx.Err(); err != nil {
+		return redisError(err)
+	}
+	err := this.BackupStorage.Get(ctx, key, value)
+	if err != nil {
+		return err
+	}
+	err = this.PreferedStorage.Set(ctx, key, value)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (this *StorageProxy) getStaleWhileRevalidate(ctx context.Context, staleGetter StaleGetter, key Key, value interface{}) error {
+	stale, err := staleGetter.GetStale(ctx, key, value)
+	if err != nil && (IsErrorEmpty(err) || IsErrorCorrupt(err)) {
+		// 已经过了hard expire或者数据损坏，只能同步加载
+		return this.getFromBackup(ctx, key, value)
+	}
+	if err != nil {
+		return err
+	}
+	if stale {
+		this.revalidate(ctx, key, reflect.TypeOf(value))
+	}
+	return nil
+}
+
+const defaultRevalidateTimeout = 10 * time.Second
+
+// revalidate 在后台从BackupStorage重新加载key并写回PreferedStorage，
+// 刷新不受调用方ctx取消的影响，超过RevalidateTimeout后放弃
+func (this *StorageProxy) revalidate(ctx context.Context, key Key, valueType reflect.Type) {
+	if valueType == nil || valueType.Kind() != reflect.Ptr {
+		return
+	}
+	// 用Key本身去重，Int(1)和String("1")是不同的key
+	this.revalidateLock.Lock()
+	if _, ok := this.revalidating[key]; ok {
+		this.revalidateLock.Unlock()
+		return
+	}
+	if this.revalidating == nil {
+		this.revalidating = make(map[Key]struct{})
+	}
+	this.revalidating[key] = struct{}{}
+	this.revalidateLock.Unlock()
+
+	timeout := this.RevalidateTimeout
+	if timeout <= 0 {
+		timeout = defaultRevalidateTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
+	// 刷新结束或者超时后允许下一次刷新，BackupStorage不响应ctx时也不会一直占住这个key
+	context.AfterFunc(ctx, func() {
+		this.revalidateLock.Lock()
+		delete(this.revalidating, key)
+		this.revalidateLock.Unlock()
+	})
+	go func() {
+		defer cancel()
+		value := reflect.New(valueType.Elem()).Interface()
+		err := this.BackupStorage.Get(ctx, key, value)
+		if err != nil {
+			log.Warningf("revalidate key %v from backup storage error %v", key, err)
+			return
+		}
+		err = this.PreferedStorage.Set(ctx, key, value)
+		if err != nil {
+			log.Warningf("revalidate key %v set prefered storage error %v", key, err)
+		}
+	}()
+}
+
+func (this *StorageProxy) Add(ctx context.Context, key Key, object interface{}) error {
 	// 这段代码先BackupStorage后PreferedStorage
 	// 因为数据库有auto increment 的情况，add时，key无意义
 	// 需要插入成功后再来获取key
@@ -71,7 +163,7 @@ func (this *StorageProxy) Add(ctx *context.Context, key Key, object interface{})
 	return nil
 }
 
-func (this *StorageProxy) Set(ctx *context.Context, key Key, object interface{}) error {
+func (this *StorageProxy) Set(ctx context.Context, key Key, object interface{}) error {
 	if object != nil {
 		err := this.PreferedStorage.Set(ctx, key, object)
 		if err != nil {
@@ -85,11 +177,14 @@ func (this *StorageProxy) Set(ctx *context.Context, key Key, object interface{})
 	return nil
 }
 
-func (this *StorageProxy) MultiGet(ctx *context.Context, keys []Key, valuesMap interface{}) error {
+// MultiGet PreferedStorage中没有取到的key(包括MultiError中失败的key)从BackupStorage加载并写回，
+// BackupStorage也没有补上的失败的key通过MultiError返回
+func (this *StorageProxy) MultiGet(ctx context.Context, keys []Key, valuesMap interface{}) error {
 	err := this.PreferedStorage.MultiGet(ctx, keys, valuesMap)
-	if err != nil {
+	preferedErr, isMultiErr := err.(*MultiError)
+	if err != nil && !isMultiErr {
+		// PreferedStorage整体失败时全部从BackupStorage加载
 		log.Warning(err)
-		return nil
 	}
 	missedKeyCount := 0
 	valueMapReflect := reflect.ValueOf(valuesMap)
@@ -100,48 +195,132 @@ func (this *StorageProxy) MultiGet(ctx *context.Context, keys []Key, valuesMap i
 			missedKeys = append(missedKeys, key)
 		}
 	}
+	multiErr := &MultiError{}
 	if missedKeyCount > 0 {
+		if err := ctx.Err(); err != nil {
+			return redisError(err)
+		}
 		missedMap := make(map[Key]interface{})
 		err := this.BackupStorage.MultiGet(ctx, missedKeys, missedMap)
-		if err != nil {
+		if backupErr, ok := err.(*MultiError); ok {
+			for _, keyErr := range backupErr.Errors {
+				multiErr.Add(keyErr.Key, StageBackup, keyErr)
+			}
+		} else if err != nil {
 			return err
 		}
-		if len(missedMap) == 0 {
-			return nil
+		if len(missedMap) > 0 {
+			if err := this.PreferedStorage.MultiSet(ctx, missedMap); err != nil {
+				log.Warningf("write back to prefered storage error %v", err)
+			}
+			for k, v := range missedMap {
+				valueMapReflect.SetMapIndex(reflect.ValueOf(k), reflect.ValueOf(v))
+			}
 		}
-		this.PreferedStorage.MultiSet(ctx, missedMap)
-		for k, v := range missedMap {
-			valueMapReflect.SetMapIndex(reflect.ValueOf(k), reflect.ValueOf(v))
+	}
+	if isMultiErr {
+		for _, keyErr := range preferedErr.Errors {
+			if !valueMapReflect.MapIndex(reflect.ValueOf(keyErr.Key)).IsValid() {
+				multiErr.Errors = append(multiErr.Errors, keyErr)
+			}
 		}
 	}
-	return nil
+	return multiErr.ErrorOrNil()
 }
 
-func (this *StorageProxy) MultiSet(ctx *context.Context, objectMap map[Key]interface{}) error {
+// MultiSet PreferedStorage返回MultiError时仍然写BackupStorage，两边失败的key合并返回
+func (this *StorageProxy) MultiSet(ctx context.Context, objectMap map[Key]interface{}) error {
+	multiErr := &MultiError{}
 	err := this.PreferedStorage.MultiSet(ctx, objectMap)
-	if err != nil {
+	if preferedErr, ok := err.(*MultiError); ok {
+		multiErr.Errors = append(multiErr.Errors, preferedErr.Errors...)
+	} else if err != nil {
 		return err
 	}
 	err = this.BackupStorage.MultiSet(ctx, objectMap)
-	if err != nil {
+	if backupErr, ok := err.(*MultiError); ok {
+		for _, keyErr := range backupErr.Errors {
+			multiErr.Add(keyErr.Key, StageBackup, keyErr)
+		}
+	} else if err != nil {
 		return err
 	}
-	return nil
+	return multiErr.ErrorOrNil()
 }
 
-func (this *StorageProxy) Delete(ctx *context.Context, key ...Key) error {
-	err := this.BackupStorage.Delete(ctx, key...)
+// Delete BackupStorage失败时仍然删除PreferedStorage中的所有key，避免缓存中留下旧的值，
+// 两边部分失败时返回合并的MultiError
+func (this *StorageProxy) Delete(ctx context.Context, key ...Key) error {
+	backupErr := this.BackupStorage.Delete(ctx, key...)
+	preferedErr := this.PreferedStorage.Delete(ctx, key...)
+	multiErr := &MultiError{}
+	if backupMultiErr, ok := backupErr.(*MultiError); ok {
+		for _, keyErr := range backupMultiErr.Errors {
+			multiErr.Add(keyErr.Key, StageBackup, keyErr)
+		}
+	} else if backupErr != nil {
+		return backupErr
+	}
+	if preferedMultiErr, ok := preferedErr.(*MultiError); ok {
+		multiErr.Errors = append(multiErr.Errors, preferedMultiErr.Errors...)
+	} else if preferedErr != nil {
+		return preferedErr
+	}
+	return multiErr.ErrorOrNil()
+}
+
+// Exists 先查PreferedStorage，不存在的key再查BackupStorage
+func (this *StorageProxy) Exists(ctx context.Context, keys ...Key) (map[Key]bool, error) {
+	preferedStorage, ok := this.PreferedStorage.(ExistsStorage)
+	if !ok {
+		return nil, errors.Newf("prefered storage %v does not support exists", reflect.TypeOf(this.PreferedStorage))
+	}
+	result, err := preferedStorage.Exists(ctx, keys...)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	missedKeys := make([]Key, 0)
+	for _, key := range keys {
+		if !result[key] {
+			missedKeys = append(missedKeys, key)
+		}
+	}
+	if len(missedKeys) == 0 {
+		return result, nil
+	}
+	backupStorage, ok := this.BackupStorage.(ExistsStorage)
+	if !ok {
+		return nil, errors.Newf("backup storage %v does not support exists", reflect.TypeOf(this.BackupStorage))
 	}
-	err = this.PreferedStorage.Delete(ctx, key...)
+	backupResult, err := backupStorage.Exists(ctx, missedKeys...)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	for _, key := range missedKeys {
+		result[key] = backupResult[key]
+	}
+	return result, nil
+}
+
+// TTL 返回PreferedStorage中key的剩余过期时间
+func (this *StorageProxy) TTL(ctx context.Context, key Key) (time.Duration, error) {
+	ttlStorage, ok := this.PreferedStorage.(TTLStorage)
+	if !ok {
+		return 0, errors.Newf("prefered storage %v does not support ttl", reflect.TypeOf(this.PreferedStorage))
+	}
+	return ttlStorage.TTL(ctx, key)
+}
+
+// Touch 刷新PreferedStorage中key的过期时间
+func (this *StorageProxy) Touch(ctx context.Context, key Key, ttl time.Duration) error {
+	ttlStorage, ok := this.PreferedStorage.(TTLStorage)
+	if !ok {
+		return errors.Newf("prefered storage %v does not support ttl", reflect.TypeOf(this.PreferedStorage))
+	}
+	return ttlStorage.Touch(ctx, key, ttl)
 }
 
-func (this *StorageProxy) Incr(ctx *context.Context, key Key, step int64) (newValue int64, err error) {
+func (this *StorageProxy) Incr(ctx context.Context, key Key, step int64) (newValue int64, err error) {
 	result, err := this.PreferedStorage.(CounterStorage).Incr(ctx, key, step)
 	if err != nil {
 		return result, err
@@ -153,7 +332,7 @@ func (this *StorageProxy) Incr(ctx *context.Context, key Key, step int64) (newVa
 	return result, err
 }
 
-func (this *StorageProxy) Decr(ctx *context.Context, key Key, step int64) (newValue int64, err error) {
+func (this *StorageProxy) Decr(ctx context.Context, key Key, step int64) (newValue int64, err error) {
 	result, err := this.PreferedStorage.(CounterStorage).Decr(ctx, key, step)
 	if err != nil {
 		return result, err
@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingStorage Get时把key发到gets，等release关闭后返回
+type blockingStorage struct {
+	mapStorage
+	gets    chan Key
+	release chan struct{}
+}
+
+func (this *blockingStorage) Get(ctx context.Context, key Key, value interface{}) error {
+	this.gets <- key
+	<-this.release
+	return this.mapStorage.Get(ctx, key, value)
+}
+
+func TestStorageProxyRevalidateDedup(t *testing.T) {
+	backup := &blockingStorage{
+		mapStorage: mapStorage{values: map[Key]interface{}{}},
+		gets:       make(chan Key, 4),
+		release:    make(chan struct{}),
+	}
+	proxy := NewStorageProxy(&mapStorage{values: map[Key]interface{}{}}, backup)
+	valueType := reflect.TypeOf(new(string))
+
+	ctx := context.Background()
+	proxy.revalidate(ctx, Int(1), valueType)
+	proxy.revalidate(ctx, Int(1), valueType)
+	proxy.revalidate(ctx, String("1"), valueType)
+
+	seen := map[Key]bool{}
+	timeout := time.After(time.Second)
+	for len(seen) < 2 {
+		select {
+		case key := <-backup.gets:
+			seen[key] = true
+		case <-timeout:
+			t.Fatalf("Int(1) and String(\"1\") should both be revalidated, got %v", seen)
+		}
+	}
+	close(backup.release)
+	select {
+	case key := <-backup.gets:
+		t.Errorf("duplicate revalidation of %v should be suppressed", key)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestStorageProxyRevalidateTimeout(t *testing.T) {
+	backup := &blockingStorage{
+		mapStorage: mapStorage{values: map[Key]interface{}{}},
+		gets:       make(chan Key, 4),
+		release:    make(chan struct{}),
+	}
+	defer close(backup.release)
+	proxy := NewStorageProxy(&mapStorage{values: map[Key]interface{}{}}, backup)
+	proxy.RevalidateTimeout = 20 * time.Millisecond
+	valueType := reflect.TypeOf(new(string))
+
+	// BackupStorage一直不返回时，超时后允许再次刷新
+	ctx := context.Background()
+	proxy.revalidate(ctx, Int(1), valueType)
+	<-backup.gets
+	time.Sleep(50 * time.Millisecond)
+	proxy.revalidate(ctx, Int(1), valueType)
+	select {
+	case <-backup.gets:
+	case <-time.After(time.Second):
+		t.Error("key should be revalidated again after the previous revalidation timed out")
+	}
+}
+
+// stringStorage 把value写入*string的BackupStorage
+type stringStorage struct {
+	lock   sync.Mutex
+	values map[Key]string
+}
+
+func (this *stringStorage) set(key Key, value string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.values[key] = value
+}
+
+func (this *stringStorage) Get(ctx context.Context, key Key, value interface{}) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	v, ok := this.values[key]
+	if !ok {
+		return EmptyObjectError{key.String()}
+	}
+	*value.(*string) = v
+	return nil
+}
+
+func (this *stringStorage) Set(ctx context.Context, key Key, object interface{}) error {
+	return nil
+}
+
+func (this *stringStorage) Add(ctx context.Context, key Key, object interface{}) error {
+	return nil
+}
+
+func (this *stringStorage) MultiGet(ctx context.Context, keys []Key, valuesMap interface{}) error {
+	return nil
+}
+
+func (this *stringStorage) MultiSet(ctx context.Context, values map[Key]interface{}) error {
+	return nil
+}
+
+func (this *stringStorage) Delete(ctx context.Context, keys ...Key) error {
+	return nil
+}
+
+func TestStorageProxyStaleWhileRevalidate(t *testing.T) {
+	ctx := context.Background()
+	server, client := newMiniRedisClient(t)
+	prefered := NewRedisStorage(client, "swr", time.Minute, JsonEncoding{}, nil, false)
+	prefered.SoftExpireTime = 20 * time.Millisecond
+	backup := &stringStorage{values: map[Key]string{String("1"): "v1"}}
+	proxy := NewStorageProxy(prefered, backup)
+	proxy.StaleWhileRevalidate = true
+
+	get := func() string {
+		var value string
+		if err := proxy.Get(ctx, String("1"), &value); err != nil {
+			t.Fatal(err)
+		}
+		return value
+	}
+	if value := get(); value != "v1" {
+		t.Fatalf("miss should be loaded from backup, got %q", value)
+	}
+
+	// 超过soft expire后立即返回旧值，后台刷新写回redis
+	backup.set(String("1"), "v2")
+	time.Sleep(30 * time.Millisecond)
+	if value := get(); value != "v1" {
+		t.Errorf("stale value should be returned immediately, got %q", value)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		var value string
+		if err := prefered.Get(ctx, String("1"), &value); err == nil && value == "v2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("background revalidation should write v2 back, got %q", value)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if value := get(); value != "v2" {
+		t.Errorf("revalidated value should be returned, got %q", value)
+	}
+
+	// 超过hard expire后同步加载
+	backup.set(String("1"), "v3")
+	server.FastForward(2 * time.Minute)
+	if value := get(); value != "v3" {
+		t.Errorf("value past hard expire should be loaded synchronously, got %q", value)
+	}
+}
@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// NoExpire 表示key存在但是没有设置过期时间
+const NoExpire time.Duration = -1
+
+// TTLStorage 由支持查询和刷新过期时间的Storage实现
+type TTLStorage interface {
+	// TTL 返回key剩余的过期时间，key不存在时返回EmptyObjectError，没有过期时间返回NoExpire
+	TTL(ctx context.Context, key Key) (time.Duration, error)
+	// Touch 把key的过期时间重新设置为ttl，key不存在时返回EmptyObjectError
+	Touch(ctx context.Context, key Key, ttl time.Duration) error
+}
+
+func redisTTL(ctx context.Context, client RedisClient, keyPrefix string, key Key) (time.Duration, error) {
+	cacheKey, err := BuildCacheKey(keyPrefix, key)
+	if err != nil {
+		return 0, wrapError(err, "build cache key error")
+	}
+	ttl, err := client.TTL(ctx, cacheKey)
+	if err != nil {
+		return 0, wrapErrorf(err, "redis ttl error key is %s", cacheKey)
+	}
+	switch {
+	case ttl == -2:
+		return 0, EmptyObjectError{key.String()}
+	case ttl < 0:
+		return NoExpire, nil
+	}
+	return ttl, nil
+}
+
+func redisTouch(ctx context.Context, client RedisClient, keyPrefix string, key Key, ttl time.Duration) error {
+	cacheKey, err := BuildCacheKey(keyPrefix, key)
+	if err != nil {
+		return wrapError(err, "build cache key error")
+	}
+	ok, err := client.Expire(ctx, cacheKey, ttl)
+	if err != nil {
+		return wrapErrorf(err, "redis expire error key is %s", cacheKey)
+	}
+	if !ok {
+		return EmptyObjectError{key.String()}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRedisStorageTTL(t *testing.T) {
+	ctx := context.Background()
+	server, client := newMiniRedisClient(t)
+	storage := NewRedisStorage(client, "ttl", 10*time.Second, JsonEncoding{}, func() interface{} { return new(string) }, false)
+
+	if _, err := storage.TTL(ctx, String("missing")); !IsErrorEmpty(err) {
+		t.Errorf("missing key ttl should be EmptyObjectError, got %v", err)
+	}
+	if err := storage.Touch(ctx, String("missing"), time.Minute); !IsErrorEmpty(err) {
+		t.Errorf("touch missing key should be EmptyObjectError, got %v", err)
+	}
+
+	storage.Set(ctx, String("1"), "a")
+	if ttl, err := storage.TTL(ctx, String("1")); err != nil || ttl != 10*time.Second {
+		t.Errorf("ttl should be 10s, got %v err=%v", ttl, err)
+	}
+	if err := storage.Touch(ctx, String("1"), time.Minute); err != nil {
+		t.Errorf("touch error %v", err)
+	}
+	if ttl, _ := storage.TTL(ctx, String("1")); ttl != time.Minute {
+		t.Errorf("ttl should be 1m after touch, got %v", ttl)
+	}
+
+	server.Set("ttl_2", `"b"`)
+	if ttl, err := storage.TTL(ctx, String("2")); err != nil || ttl != NoExpire {
+		t.Errorf("key without expire should be NoExpire, got %v err=%v", ttl, err)
+	}
+}
+
+func TestRedisStorageSlidingExpiration(t *testing.T) {
+	ctx := context.Background()
+	server, client := newMiniRedisClient(t)
+	storage := NewRedisStorage(client, "sliding", 10*time.Second, JsonEncoding{}, func() interface{} { return new(string) }, false)
+	storage.SlidingExpiration = true
+
+	storage.Set(ctx, String("1"), "a")
+	server.FastForward(6 * time.Second)
+	var value string
+	if err := storage.Get(ctx, String("1"), &value); err != nil || value != "a" {
+		t.Fatalf("get error value=%q err=%v", value, err)
+	}
+	if ttl, _ := storage.TTL(ctx, String("1")); ttl != 10*time.Second {
+		t.Errorf("get should refresh ttl to 10s, got %v", ttl)
+	}
+
+	server.FastForward(6 * time.Second)
+	values := map[Key]interface{}{}
+	if err := storage.MultiGet(ctx, []Key{String("1"), String("2")}, values); err != nil || len(values) != 1 {
+		t.Fatalf("multi get error values=%v err=%v", values, err)
+	}
+	if ttl, _ := storage.TTL(ctx, String("1")); ttl != 10*time.Second {
+		t.Errorf("multi get should refresh ttl to 10s, got %v", ttl)
+	}
+	if _, err := storage.TTL(ctx, String("2")); !IsErrorEmpty(err) {
+		t.Errorf("multi get should not create missing key, got %v", err)
+	}
+
+	server.FastForward(11 * time.Second)
+	if err := storage.Get(ctx, String("1"), &value); !IsErrorEmpty(err) {
+		t.Errorf("key should expire without access, got %v", err)
+	}
+}
@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"context"
+	"reflect"
+	"time"
+)
+
+// TypedKey TypedStorage的key类型，需要能作为map的key
+type TypedKey interface {
+	Key
+	comparable
+}
+
+// TypedStorage 在Storage外面包一层泛型接口，类型错误在编译期发现。
+// 底层Storage的Get/Set/MultiSet收到的都是*V，MultiGet收到的是map[Key]*V，
+// 所以自定义的Storage(比如StorageProxy的BackupStorage)在MultiGet中也要放入*V
+type TypedStorage[K TypedKey, V any] struct {
+	storage Storage
+}
+
+func NewTypedStorage[K TypedKey, V any](storage Storage) TypedStorage[K, V] {
+	return TypedStorage[K, V]{storage: storage}
+}
+
+// NewTypedRedisStorage 不需要newObject，按V的类型创建对象
+func NewTypedRedisStorage[K TypedKey, V any](client RedisClient, keyPrefix string, defaultExpireTime time.Duration, encoding Encoding) TypedStorage[K, V] {
+	redisStorage := NewRedisStorage(client, keyPrefix, defaultExpireTime, encoding, func() interface{} { return new(V) }, false)
+	return NewTypedStorage[K, V](redisStorage)
+}
+
+// Storage 返回底层的Storage
+func (this TypedStorage[K, V]) Storage() Storage {
+	return this.storage
+}
+
+func (this TypedStorage[K, V]) Get(ctx context.Context, key K) (V, error) {
+	var value V
+	err := this.storage.Get(ctx, key, &value)
+	return value, err
+}
+
+func (this TypedStorage[K, V]) Set(ctx context.Context, key K, value V) error {
+	return this.storage.Set(ctx, key, &value)
+}
+
+func (this TypedStorage[K, V]) Add(ctx context.Context, key K, value V) error {
+	return this.storage.Add(ctx, key, &value)
+}
+
+// MultiGet 返回的map中只包含命中的key，部分key失败时同时返回已经取到的结果和MultiError
+func (this TypedStorage[K, V]) MultiGet(ctx context.Context, keys []K) (map[K]V, error) {
+	storageKeys := make([]Key, len(keys))
+	for i, key := range keys {
+		storageKeys[i] = key
+	}
+	valuesMap := make(map[Key]*V, len(keys))
+	err := this.storage.MultiGet(ctx, storageKeys, valuesMap)
+	if _, ok := err.(*MultiError); err != nil && !ok {
+		return nil, err
+	}
+	result := make(map[K]V, len(valuesMap))
+	for key, value := range valuesMap {
+		if value != nil {
+			result[key.(K)] = *value
+		}
+	}
+	return result, err
+}
+
+// TypedResult 是MultiGetSlice/MultiGetEach中一个key的结果，含义同MultiGetResult
+type TypedResult[K TypedKey, V any] struct {
+	Key   K
+	Value V
+	Found bool
+	Err   error
+}
+
+// MultiGetSlice 返回和keys一一对应的结果
+func (this TypedStorage[K, V]) MultiGetSlice(ctx context.Context, keys []K) ([]TypedResult[K, V], error) {
+	results := make([]TypedResult[K, V], len(keys))
+	err := this.MultiGetEach(ctx, keys, 0, func(i int, result TypedResult[K, V]) error {
+		results[i] = result
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// MultiGetEach 底层Storage实现了OrderedStorage时按batchSize分批读取，
+// 否则用一次MultiGet读取全部key，per-key的error来自MultiError
+func (this TypedStorage[K, V]) MultiGetEach(ctx context.Context, keys []K, batchSize int, fn func(i int, result TypedResult[K, V]) error) error {
+	storageKeys := make([]Key, len(keys))
+	for i, key := range keys {
+		storageKeys[i] = key
+	}
+	if orderedStorage, ok := this.storage.(OrderedStorage); ok {
+		return orderedStorage.MultiGetEach(ctx, storageKeys, reflect.TypeOf((*V)(nil)), batchSize, func(i int, result MultiGetResult) error {
+			typedResult := TypedResult[K, V]{Key: keys[i], Found: result.Found, Err: result.Err}
+			if result.Found {
+				typedResult.Value = *result.Value.(*V)
+			}
+			return fn(i, typedResult)
+		})
+	}
+
+	valuesMap := make(map[Key]*V, len(keys))
+	keyErrs := make(map[Key]error)
+	err := this.storage.MultiGet(ctx, storageKeys, valuesMap)
+	if multiErr, ok := err.(*MultiError); ok {
+		for _, keyErr := range multiErr.Errors {
+			keyErrs[keyErr.Key] = keyErr
+		}
+	} else if err != nil {
+		return err
+	}
+	for i, key := range keys {
+		result := TypedResult[K, V]{Key: key, Err: keyErrs[key]}
+		if value, ok := valuesMap[key]; ok && value != nil {
+			result.Value = *value
+			result.Found = true
+		}
+		if err := fn(i, result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (this TypedStorage[K, V]) MultiSet(ctx context.Context, values map[K]V) error {
+	valuesMap := make(map[Key]interface{}, len(values))
+	for key, value := range values {
+		value := value
+		valuesMap[key] = &value
+	}
+	return this.storage.MultiSet(ctx, valuesMap)
+}
+
+func (this TypedStorage[K, V]) Delete(ctx context.Context, keys ...K) error {
+	storageKeys := make([]Key, len(keys))
+	for i, key := range keys {
+		storageKeys[i] = key
+	}
+	return this.storage.Delete(ctx, storageKeys...)
+}
+
+// OrderedStorage 由可以按keys顺序返回per-key结果的Storage实现，
+// valueType是结果的类型，和MultiGet传入的map的value类型含义相同
+type OrderedStorage interface {
+	MultiGetSlice(ctx context.Context, keys []Key, valueType reflect.Type) ([]MultiGetResult, error)
+	MultiGetEach(ctx context.Context, keys []Key, valueType reflect.Type, batchSize int, fn func(i int, result MultiGetResult) error) error
+}
@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+type typedStorageUser struct {
+	Id   int64
+	Name string
+}
+
+func TestTypedStorage(t *testing.T) {
+	ctx := context.Background()
+	storage := NewTypedRedisStorage[Int, typedStorageUser](newMockRedisClient(), "typed", 0, JsonEncoding{})
+
+	if err := storage.Set(ctx, Int(1), typedStorageUser{Id: 1, Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.MultiSet(ctx, map[Int]typedStorageUser{2: {Id: 2, Name: "b"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := storage.Get(ctx, Int(1))
+	if err != nil || user.Name != "a" {
+		t.Errorf("get failed, user=%+v err=%v", user, err)
+	}
+	if _, err := storage.Get(ctx, Int(3)); !IsErrorEmpty(err) {
+		t.Errorf("get missing key should return EmptyObjectError, got %v", err)
+	}
+
+	users, err := storage.MultiGet(ctx, []Int{1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users[1].Name != "a" || users[2].Name != "b" {
+		t.Errorf("multi get failed, users=%+v", users)
+	}
+
+	if err := storage.Delete(ctx, Int(1)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.Get(ctx, Int(1)); !IsErrorEmpty(err) {
+		t.Errorf("deleted key should be missing, got %v", err)
+	}
+}
+
+func TestTypedStorageMultiGetSlice(t *testing.T) {
+	ctx := context.Background()
+	storage := NewTypedRedisStorage[Int, typedStorageUser](newMockRedisClient(), "typed", 0, JsonEncoding{})
+	storage.MultiSet(ctx, map[Int]typedStorageUser{1: {Id: 1, Name: "a"}, 2: {Id: 2, Name: "b"}})
+
+	results, err := storage.MultiGetSlice(ctx, []Int{2, 3, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 || results[0].Value.Name != "b" || results[1].Found || results[2].Value.Name != "a" {
+		t.Errorf("multi get slice failed, results=%+v", results)
+	}
+}
+
+// 没有newObject的RedisStorage和MultiGet一样按V的类型创建对象
+func TestTypedStorageMultiGetSliceWithoutNewObject(t *testing.T) {
+	ctx := context.Background()
+	redisStorage := NewRedisStorage(newMockRedisClient(), "typed", 0, JsonEncoding{}, nil, false)
+	storage := NewTypedStorage[Int, typedStorageUser](redisStorage)
+	storage.MultiSet(ctx, map[Int]typedStorageUser{1: {Id: 1, Name: "a"}})
+
+	results, err := storage.MultiGetSlice(ctx, []Int{1, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || !results[0].Found || results[0].Value.Name != "a" || results[1].Found {
+		t.Errorf("multi get slice failed, results=%+v", results)
+	}
+
+	if _, err := redisStorage.MultiGetSlice(ctx, []Key{Int(1)}, nil); err == nil {
+		t.Error("MultiGetSlice without newObject or value type should fail")
+	}
+	if _, err := redisStorage.MultiGetSlice(ctx, []Key{Int(1)}, reflect.TypeOf(typedStorageUser{})); err == nil {
+		t.Error("MultiGetSlice without newObject should need a pointer value type")
+	}
+}
@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"encoding"
+	"reflect"
+	"sync"
+	"unsafe"
+)
+
+// stringBytes 不复制地把string转成[]byte，返回的slice只能读不能写
+func stringBytes(s string) []byte {
+	if len(s) == 0 {
+		return nil
+	}
+	return unsafe.Slice(unsafe.StringData(s), len(s))
+}
+
+// bytesString 不复制地把[]byte转成string，转换后b不能再被修改
+func bytesString(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	return unsafe.String(unsafe.SliceData(b), len(b))
+}
+
+// StringUnmarshaler 由可以直接从string解码的Encoding实现，
+// 实现时不能修改或者保留data的引用(data可能指向redis返回的string或者会被复用的buffer)
+type StringUnmarshaler interface {
+	UnmarshalString(data string, value interface{}) error
+}
+
+// UnmarshalString e实现了StringUnmarshaler时不复制data，否则复制一份交给Unmarshal。
+// v实现了encoding.BinaryUnmarshaler时也交给Unmarshal，解码失败时可以用UnmarshalBinary
+func UnmarshalString(e Encoding, data string, v interface{}) error {
+	if su, ok := e.(StringUnmarshaler); ok && !isBinaryUnmarshaler(v) {
+		return su.UnmarshalString(data, v)
+	}
+	return Unmarshal(e, []byte(data), v)
+}
+
+func isBinaryUnmarshaler(v interface{}) bool {
+	_, ok := v.(encoding.BinaryUnmarshaler)
+	return ok
+}
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 0, 4096)
+		return &buf
+	},
+}
+
+func getBuffer() *[]byte {
+	return bufferPool.Get().(*[]byte)
+}
+
+// putBuffer 太大的buffer不放回pool，避免一次大value长期占用内存
+func putBuffer(buf *[]byte) {
+	if cap(*buf) > 1<<20 {
+		return
+	}
+	*buf = (*buf)[:0]
+	bufferPool.Put(buf)
+}
+
+// ObjectPool 复用MultiGet解码用的对象，设置到RedisStorage.ObjectPool后，
+// MultiGet返回的对象使用完后要调用Put(或RedisStorage.Release)放回
+type ObjectPool struct {
+	pool  sync.Pool
+	reset func(object interface{})
+}
+
+// NewObjectPool reset在对象放回pool前调用，为nil时把对象置为零值。
+// 自定义reset可以保留slice等字段的容量，但必须清空所有会被Unmarshal合并的内容
+func NewObjectPool(newObject func() interface{}, reset func(object interface{})) *ObjectPool {
+	if reset == nil {
+		reset = resetObject
+	}
+	return &ObjectPool{
+		pool:  sync.Pool{New: newObject},
+		reset: reset,
+	}
+}
+
+func resetObject(object interface{}) {
+	value := reflect.ValueOf(object)
+	if value.Kind() == reflect.Ptr && !value.IsNil() {
+		value.Elem().Set(reflect.Zero(value.Elem().Type()))
+	}
+}
+
+func (this *ObjectPool) Get() interface{} {
+	return this.pool.Get()
+}
+
+func (this *ObjectPool) Put(object interface{}) {
+	if object == nil {
+		return
+	}
+	this.reset(object)
+	this.pool.Put(object)
+}